@@ -2,89 +2,107 @@ package repl
 
 import (
 	"fmt"
-	"os"
+	"io"
 )
 
 // TODO: dont use the functions that aren't supported by Windows
 
 const _ESC = "\033"
 
-func csi1(n int, char byte) {
-	fmt.Fprintf(os.Stdout, "%s[%d%c", _ESC, n, char)
+func csi1(w io.Writer, n int, char byte) {
+	fmt.Fprintf(w, "%s[%d%c", _ESC, n, char)
 }
 
-func csi2(n int, m int, char byte) {
-	fmt.Fprintf(os.Stdout, "%s[%d;%d%c", _ESC, n, m, char)
+func csi2(w io.Writer, n int, m int, char byte) {
+	fmt.Fprintf(w, "%s[%d;%d%c", _ESC, n, m, char)
 }
 
-func esc1(c byte) {
-	fmt.Fprintf(os.Stdout, "%s[%c", _ESC, c)
+func esc1(w io.Writer, c byte) {
+	fmt.Fprintf(w, "%s[%c", _ESC, c)
 }
 
-func control(char byte) {
-	fmt.Fprintf(os.Stdout, "%c", char)
+func control(w io.Writer, char byte) {
+	fmt.Fprintf(w, "%c", char)
 }
 
-func moveLeft() {
-	csi1(1, 'D')
+func moveLeft(w io.Writer) {
+	csi1(w, 1, 'D')
 }
 
-func moveRight() {
-	csi1(1, 'C')
+func moveRight(w io.Writer) {
+	csi1(w, 1, 'C')
 }
 
-func clearScreen() {
-	csi1(2, 'J')
+func clearScreen(w io.Writer) {
+	csi1(w, 2, 'J')
 }
 
-func moveToRowStart() {
-	csi1(1, 'G')
+func clearScreenAfterCursor(w io.Writer) {
+	csi1(w, 0, 'J')
 }
 
-func moveToScreenStart() {
-	csi2(1, 1, 'H')
+func moveToRowStart(w io.Writer) {
+	csi1(w, 1, 'G')
 }
 
-func moveToRow(y int) {
-	csi2(y+1, 1, 'H')
+func moveToScreenStart(w io.Writer) {
+	csi2(w, 1, 1, 'H')
 }
 
-func clearRow() {
-	csi1(2, 'K')
+func moveToRow(w io.Writer, y int) {
+	csi2(w, y+1, 1, 'H')
 }
 
-func clearRowAfterCursor() {
-	csi1(0, 'K')
+func clearRow(w io.Writer) {
+	csi1(w, 2, 'K')
 }
 
-func clearRows(n int) {
+func clearRowAfterCursor(w io.Writer) {
+	csi1(w, 0, 'K')
+}
+
+func clearRows(w io.Writer, n int) {
 	for i := 0; i < n; i++ {
-		csi1(2, 'K')
+		csi1(w, 2, 'K')
 
-		csi1(1, 'F')
+		csi1(w, 1, 'F')
 	}
 }
 
 // input: 0-based
 // moves to 1-based
-func moveToCol(x int) {
-	csi1(x+1, 'G')
+func moveToCol(w io.Writer, x int) {
+	csi1(w, x+1, 'G')
 }
 
-func queryCursorPos() {
-	csi1(6, 'n')
+func queryCursorPos(w io.Writer) {
+	csi1(w, 6, 'n')
 }
 
 // from 0-based to 1-based!
-func moveCursorTo(x, y int) {
-	csi2(y+1, x+1, 'H')
+func moveCursorTo(w io.Writer, x, y int) {
+	csi2(w, y+1, x+1, 'H')
 }
 
-func highlight() {
+func highlight(w io.Writer) {
 	// black text (30) on a grey/white background
-	fmt.Fprintf(os.Stdout, "%s[48;5;247m%s[30m", _ESC, _ESC)
+	fmt.Fprintf(w, "%s[48;5;247m%s[30m", _ESC, _ESC)
+}
+
+// style contains SGR parameters, e.g. "1;34" for bold blue text
+func setStyle(w io.Writer, style string) {
+	fmt.Fprintf(w, "%s[%sm", _ESC, style)
+}
+
+func resetDecorations(w io.Writer) {
+	fmt.Fprintf(w, "%s[0m", _ESC)
+}
+
+// pasted text is surrounded by `ESC [ 200 ~` and `ESC [ 201 ~`
+func enableBracketedPaste(w io.Writer) {
+	fmt.Fprintf(w, "%s[?2004h", _ESC)
 }
 
-func resetDecorations() {
-	fmt.Fprintf(os.Stdout, "%s[0m", _ESC)
+func disableBracketedPaste(w io.Writer) {
+	fmt.Fprintf(w, "%s[?2004l", _ESC)
 }
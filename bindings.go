@@ -0,0 +1,378 @@
+package repl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// An editing action that can be bound to a key with Repl.Bind. Use NamedAction for the built-in actions, or CustomAction for your own.
+type Action struct {
+	name string
+	fn   func(r *Repl)
+}
+
+// the built-in actions, named after the methods that implement them
+var actions = map[string]func(r *Repl){
+	"moveToBufferStart":        func(r *Repl) { r.moveToBufferStart() },
+	"moveToBufferEnd":          acceptSuggestionOr(false, (*Repl).moveToBufferEnd),
+	"moveLeftOneChar":          func(r *Repl) { r.moveLeftOneChar() },
+	"moveRightOneChar":         acceptSuggestionOr(false, (*Repl).moveRightOneChar),
+	"moveLeftOnePhrase":        func(r *Repl) { r.moveLeftOnePhrase() },
+	"moveRightOnePhrase":       acceptSuggestionOr(true, (*Repl).moveRightOnePhrase),
+	"moveUpOneLine":            func(r *Repl) { r.moveUpOneLine() },
+	"moveDownOneLine":          func(r *Repl) { r.moveDownOneLine() },
+	"moveUpOrHistoryBack":      func(r *Repl) { r.moveUpOrHistoryBack() },
+	"moveDownOrHistoryForward": func(r *Repl) { r.moveDownOrHistoryForward() },
+	"historyBack":              func(r *Repl) { r.historyBack() },
+	"historyForward":           func(r *Repl) { r.historyForward() },
+	"backspace":                func(r *Repl) { r.backspaceActiveBuffer() },
+	"deleteChar":               func(r *Repl) { r.deleteChar() },
+	"clearToEnd":               exitSearchOr((*Repl).clearToEnd),
+	"clearToStart":             exitSearchOr((*Repl).clearToStart),
+	"clearOnePhraseLeft":       exitSearchOr((*Repl).clearOnePhraseLeft),
+	"clearOnePhraseRight":      exitSearchOr((*Repl).clearOnePhraseRight),
+	"insertPrevDel": exitSearchOr(func(r *Repl) {
+		r.clearStatus()
+		r.insertPrevDel()
+		r.writeStatus()
+	}),
+	"yankPop":       exitSearchOr((*Repl).yankPop),
+	"insertNewline": exitSearchOr((*Repl).insertNewline),
+	"complete": exitSearchOr(func(r *Repl) {
+		r.tab(r.tabbed)
+	}),
+	"evalBuffer": exitSearchOr(func(r *Repl) {
+		if r.isComplete() {
+			r.evalBuffer()
+		} else {
+			r.undoable("", r.insertNewline)
+		}
+	}),
+	"forceEvalBuffer": exitSearchOr((*Repl).evalBuffer),
+	"startReverseSearch": func(r *Repl) {
+		if !r.searchActive() {
+			r.startReverseSearch()
+		}
+	},
+	"startHistoryPicker": func(r *Repl) {
+		if r.searchActive() {
+			r.stopSearch()
+		}
+
+		r.startHistoryPicker()
+	},
+	"clearBuffer": func(r *Repl) {
+		if r.searchActive() {
+			r.stopSearch()
+		}
+
+		r.clearBuffer()
+		r.writeStatus()
+	},
+	"cancel": exitSearchOr(func(r *Repl) {
+		r.clearBuffer()
+		r.writeStatus()
+	}),
+	"undo":         exitSearchOr(func(r *Repl) { r.undo() }),
+	"redo":         exitSearchOr(func(r *Repl) { r.redo() }),
+	"redrawScreen": func(r *Repl) { r.redrawScreen() },
+	"quit":         func(r *Repl) { r.quit() },
+	"ignore":       func(r *Repl) {},
+}
+
+// most edit commands exit the reverse-search mode
+func exitSearchOr(fn func(r *Repl)) func(r *Repl) {
+	return func(r *Repl) {
+		if r.searchActive() {
+			// the action itself didn't happen, so it mustn't be seen as the previous action (e.g. by yankPop)
+			r.action = ""
+			r.stopSearch()
+		} else {
+			fn(r)
+		}
+	}
+}
+
+// at the end of the buffer, moving right inserts the suggestion (or its first word)
+func acceptSuggestionOr(word bool, fn func(r *Repl)) func(r *Repl) {
+	return func(r *Repl) {
+		if !r.acceptSuggestion(word) {
+			fn(r)
+		}
+	}
+}
+
+var defaultBindings = map[string]string{
+	"ctrl-a":        "moveToBufferStart",
+	"home":          "moveToBufferStart",
+	"ctrl-e":        "moveToBufferEnd",
+	"end":           "moveToBufferEnd",
+	"ctrl-b":        "moveLeftOneChar",
+	"left":          "moveLeftOneChar",
+	"ctrl-f":        "moveRightOneChar",
+	"right":         "moveRightOneChar",
+	"ctrl-left":     "moveLeftOnePhrase",
+	"ctrl-right":    "moveRightOnePhrase",
+	"ctrl-p":        "historyBack",
+	"up":            "moveUpOrHistoryBack",
+	"ctrl-n":        "historyForward",
+	"down":          "moveDownOrHistoryForward",
+	"ctrl-up":       "moveUpOneLine",
+	"ctrl-down":     "moveDownOneLine",
+	"ctrl-h":        "backspace",
+	"backspace":     "backspace",
+	"delete":        "deleteChar",
+	"ctrl-k":        "clearToEnd",
+	"ctrl-u":        "clearToStart",
+	"ctrl-w":        "clearOnePhraseLeft",
+	"ctrl-q":        "clearOnePhraseRight",
+	"ctrl-y":        "insertPrevDel",
+	"ctrl-j":        "insertNewline", // most terminals send CTRL-J (i.e. a newline) for SHIFT-ENTER
+	"shift-enter":   "insertNewline",
+	"tab":           "complete",
+	"enter":         "evalBuffer",
+	"alt-enter":     "forceEvalBuffer",
+	"ctrl-r":        "startReverseSearch",
+	"alt-r":         "startHistoryPicker",
+	"ctrl-c":        "clearBuffer",
+	"esc":           "cancel",
+	"ctrl-l":        "redrawScreen",
+	"ctrl-d":        "quit",
+	"ctrl-_":        "undo",
+	"ctrl-x ctrl-u": "undo",
+	"alt-_":         "redo",
+	"alt-y":         "yankPop",
+}
+
+func newBindings() map[string]Action {
+	bindings := make(map[string]Action)
+
+	for key, name := range defaultBindings {
+		bindings[key], _ = NamedAction(name)
+	}
+
+	return bindings
+}
+
+// Returns the built-in action with the given name (e.g. "moveLeftOnePhrase", "clearToEnd" or "startReverseSearch"), see ActionNames for the complete list.
+func NamedAction(name string) (Action, bool) {
+	fn, ok := actions[name]
+	if !ok {
+		return Action{}, false
+	}
+
+	return Action{name, fn}, true
+}
+
+// Returns the names of all the built-in actions, in alphabetical order. Bind a key to "ignore" to disable it.
+func ActionNames() []string {
+	names := make([]string, 0, len(actions))
+
+	for name := range actions {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Create an action that edits the buffer. fn receives the current buffer and the cursor position (byte offset in the buffer), and returns the new buffer and cursor position.
+// The returned position is clamped to the buffer, and moved to the start of the character it points into.
+//
+// fn is called synchronously by Loop, so it can't call the methods of Repl.
+func CustomAction(fn func(buffer string, pos int) (string, int)) Action {
+	return Action{"custom", func(r *Repl) {
+		if r.searchActive() {
+			r.stopSearch()
+		}
+
+		buffer, pos := fn(string(r.buffer), r.bufferPos)
+
+		if pos < 0 {
+			pos = 0
+		} else if pos > len(buffer) {
+			pos = len(buffer)
+		}
+
+		r.force([]byte(buffer), pos)
+	}}
+}
+
+var keyNameCodes = func() map[string]KeyCode {
+	codes := make(map[string]KeyCode)
+
+	for code, name := range keyNames {
+		codes[name] = code
+	}
+
+	codes["escape"] = KEY_ESCAPE
+	codes["return"] = KEY_ENTER
+	codes["del"] = KEY_DELETE
+	codes["ins"] = KEY_INSERT
+
+	return codes
+}()
+
+// Parse a key name as returned by Key.String, e.g. "ctrl-q", "alt-f", "shift-tab", "f1" or "x".
+// Modifiers and key names are case-insensitive, single characters are not.
+func ParseKey(s string) (Key, error) {
+	var mod Modifier
+
+	rest := s
+	for {
+		lower := strings.ToLower(rest)
+
+		if strings.HasPrefix(lower, "ctrl-") && len(rest) > 5 {
+			mod |= MOD_CTRL
+			rest = rest[5:]
+		} else if strings.HasPrefix(lower, "alt-") && len(rest) > 4 {
+			mod |= MOD_ALT
+			rest = rest[4:]
+		} else if strings.HasPrefix(lower, "shift-") && len(rest) > 6 {
+			mod |= MOD_SHIFT
+			rest = rest[6:]
+		} else {
+			break
+		}
+	}
+
+	if utf8.RuneCountInString(rest) == 1 {
+		c, _ := utf8.DecodeRuneInString(rest)
+
+		if mod&MOD_CTRL != 0 && c >= 'A' && c <= 'Z' {
+			// terminals can't distinguish CTRL-A from CTRL-SHIFT-A
+			c = c - 'A' + 'a'
+		}
+
+		return Key{Code: KEY_RUNE, Rune: c, Mod: mod}, nil
+	}
+
+	switch lower := strings.ToLower(rest); lower {
+	case "space":
+		return Key{Code: KEY_RUNE, Rune: ' ', Mod: mod}, nil
+	case "minus":
+		return Key{Code: KEY_RUNE, Rune: '-', Mod: mod}, nil
+	default:
+		if code, ok := keyNameCodes[lower]; ok {
+			return Key{Code: code, Mod: mod}, nil
+		}
+	}
+
+	return Key{}, fmt.Errorf("invalid key %q", s)
+}
+
+// parse a space separated sequence of keys into its canonical form
+func parseKeySequence(s string) (string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty key sequence")
+	}
+
+	for i, field := range fields {
+		k, err := ParseKey(field)
+		if err != nil {
+			return "", err
+		}
+
+		fields[i] = k.String()
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// Bind an action to a key (e.g. "ctrl-q" or "f1"), or to a space separated sequence of keys (e.g. "ctrl-x ctrl-e"), replacing the existing binding.
+// See ParseKey for the key names. Bind the "ignore" action to disable a key.
+//
+// Printable characters are inserted into the buffer unless they are bound. Keystrokes that are used by the completion menu while it is open can't be rebound.
+func (r *Repl) Bind(keys string, action Action) error {
+	seq, err := parseKeySequence(keys)
+	if err != nil {
+		return err
+	}
+
+	if action.fn == nil {
+		return fmt.Errorf("invalid action")
+	}
+
+	r.do(func() {
+		r.bindings[seq] = action
+	})
+
+	return nil
+}
+
+// true if seq is the start of a longer bound key sequence
+func (r *Repl) isBindingPrefix(seq string) bool {
+	for bound := range r.bindings {
+		if strings.HasPrefix(bound, seq+" ") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the key sequence typed so far, ending with k
+func (r *Repl) keySequence(k Key) string {
+	keys := make([]string, 0, len(r.keyPrefix)+1)
+
+	for _, p := range r.keyPrefix {
+		keys = append(keys, p.String())
+	}
+
+	return strings.Join(append(keys, k.String()), " ")
+}
+
+// printable characters are inserted directly, unless they are bound or part of a key sequence
+// (in vi mode every keystroke is dispatched separately, so it can be repeated by '.')
+func (r *Repl) isUnboundText(k Key) bool {
+	if !k.isText() || len(r.keyPrefix) > 0 || r.vi != nil {
+		return false
+	}
+
+	_, bound := r.bindings[k.String()]
+
+	return !bound && !r.isBindingPrefix(k.String())
+}
+
+func (r *Repl) dispatchBinding(k Key) {
+	seq := r.keySequence(k)
+
+	if action, ok := r.bindings[seq]; ok {
+		r.keyPrefix = r.keyPrefix[:0]
+
+		r.log("action: %s\n", action.name)
+
+		r.action = action.name
+
+		// complete reads r.tabbed to detect a second TAB, and sets it if several candidates are left
+		tabbed := r.tabbed
+		if undoExempt[action.name] {
+			action.fn(r)
+		} else {
+			r.undoable("", func() {
+				action.fn(r)
+			})
+		}
+		if r.tabbed == tabbed {
+			r.tabbed = false
+		}
+	} else if r.isBindingPrefix(seq) {
+		r.keyPrefix = append(r.keyPrefix, k)
+	} else if len(r.keyPrefix) > 0 {
+		// unbound key sequences are discarded
+		r.keyPrefix = r.keyPrefix[:0]
+		r.tabbed = false
+	} else {
+		r.tabbed = false
+
+		if k.isText() {
+			r.undoable("insert", func() {
+				r.addTextToActiveBuffer([]byte(string(k.Rune)))
+			})
+		}
+	}
+}
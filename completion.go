@@ -0,0 +1,347 @@
+package repl
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// Maximum number of rows used by the completion menu below the prompt.
+	COMPLETION_MENU_ROWS = 10
+)
+
+// A single completion candidate returned by a Completer.
+type Candidate struct {
+	Text        string // replaces the Completion span of the buffer
+	Display     string // shown in the completion menu, Text is shown if empty
+	Description string // optional, shown next to the Display text
+}
+
+// Result of Completer.Complete.
+type Completion struct {
+	Start      int // byte offset in the buffer of the start of the text that is replaced by a candidate
+	End        int // byte offset in the buffer of the end of the text that is replaced by a candidate
+	Candidates []Candidate
+}
+
+// _CompletionMenu lists the candidates below the prompt, and keeps track of the selected candidate
+type _CompletionMenu struct {
+	completion Completion
+	start      int // span of the buffer currently replaced by the selected candidate
+	end        int
+	selected   int // -1 before the first selection
+	offset     int // first visible row
+	backup     []byte
+	backupPos  int
+}
+
+func (c *Candidate) display() string {
+	if c.Display != "" {
+		return c.Display
+	} else {
+		return c.Text
+	}
+}
+
+// longest common prefix, cut at a rune boundary
+func commonPrefix(candidates []Candidate) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	prefix := candidates[0].Text
+
+	for _, c := range candidates[1:] {
+		n := 0
+		for n < len(prefix) && n < len(c.Text) && prefix[n] == c.Text[n] {
+			n++
+		}
+
+		prefix = prefix[0:n]
+	}
+
+	for len(prefix) > 0 && !utf8.ValidString(prefix) {
+		prefix = prefix[0 : len(prefix)-1]
+	}
+
+	return prefix
+}
+
+// first TAB inserts the single candidate or the common prefix of all the candidates, a second TAB opens the menu
+func (r *Repl) complete(completer Completer, secondTab bool) {
+	c := completer.Complete(string(r.buffer), r.bufferPos)
+
+	if c.Start < 0 || c.End > r.bufferLen() || c.Start > c.End || len(c.Candidates) == 0 {
+		return
+	}
+
+	if len(c.Candidates) == 1 {
+		r.replaceSpan(c.Start, c.End, c.Candidates[0].Text)
+		return
+	}
+
+	current := string(r.buffer[c.Start:c.End])
+
+	prefix := commonPrefix(c.Candidates)
+
+	if len(prefix) > len(current) && strings.HasPrefix(prefix, current) {
+		r.replaceSpan(c.Start, c.End, prefix)
+
+		// the prefix is still ambiguous, so the next TAB opens the menu
+		r.tabbed = true
+	} else if secondTab {
+		r.openMenu(c)
+	} else {
+		r.tabbed = true
+	}
+}
+
+// returns the new end of the span
+func (r *Repl) replaceSpan(start, end int, text string) int {
+	newBuffer := make([]byte, 0)
+	newBuffer = append(newBuffer, r.buffer[0:start]...)
+	newBuffer = append(newBuffer, []byte(text)...)
+	newBuffer = append(newBuffer, r.buffer[end:]...)
+
+	newEnd := start + len(text)
+
+	r.force(newBuffer, newEnd)
+
+	return newEnd
+}
+
+func (r *Repl) menuActive() bool {
+	return r.menu != nil
+}
+
+func (r *Repl) openMenu(c Completion) {
+	r.menu = &_CompletionMenu{
+		completion: c,
+		start:      c.Start,
+		end:        c.End,
+		selected:   -1,
+		offset:     0,
+		backup:     copyBytes(r.buffer),
+		backupPos:  r.bufferPos,
+	}
+
+	r.drawMenu()
+}
+
+// the menu rows are below the last visible row of the buffer
+func (r *Repl) menuRow() int {
+	n := r.viewEnd
+	if n < 0 {
+		n = r.bufferLen()
+	}
+
+	_, y := r.cursorCoord(n)
+
+	return y + 1
+}
+
+// make room for n rows below the buffer by scrolling the terminal, returns the first row
+func (r *Repl) reserveMenuRows(n int) int {
+	y0 := r.menuRow()
+
+	if dy := y0 + n - r.innerHeight(); dy > 0 {
+		moveCursorTo(r.term, 0, r.getHeight()-1)
+
+		for i := 0; i < dy; i++ {
+			fmt.Fprint(r.term, "\n")
+		}
+
+		r.updatePromptRow(r.promptRow - dy)
+
+		y0 -= dy
+	}
+
+	return y0
+}
+
+func (r *Repl) closeMenu() {
+	if r.menu == nil {
+		return
+	}
+
+	r.menu = nil
+
+	moveCursorTo(r.term, 0, r.menuRow())
+	clearScreenAfterCursor(r.term)
+
+	r.writeStatus()
+}
+
+// candidates with a description are listed one per row, otherwise the candidates are listed in columns
+func (m *_CompletionMenu) columns(w int) int {
+	colWidth := 0
+
+	for _, c := range m.completion.Candidates {
+		if c.Description != "" {
+			return 1
+		}
+
+		if cw := displayWidth(c.display()) + 2; cw > colWidth {
+			colWidth = cw
+		}
+	}
+
+	if colWidth >= w {
+		return 1
+	}
+
+	return w / colWidth
+}
+
+func (m *_CompletionMenu) rows(w int) int {
+	cols := m.columns(w)
+
+	return (len(m.completion.Candidates) + cols - 1) / cols
+}
+
+// write a single row of the menu at the current cursor position
+func (r *Repl) writeMenuRow(row int) {
+	m := r.menu
+	w := r.getWidth()
+	cols := m.columns(w)
+	candidates := m.completion.Candidates
+
+	displayWidths := 0
+	for _, c := range candidates {
+		if dw := displayWidth(c.display()); dw > displayWidths {
+			displayWidths = dw
+		}
+	}
+
+	colWidth := w / cols
+	if cols == 1 {
+		colWidth = w
+	}
+
+	for i := row * cols; i < (row+1)*cols && i < len(candidates); i++ {
+		c := candidates[i]
+
+		text := c.display()
+		if c.Description != "" {
+			text = text + strings.Repeat(" ", displayWidths-displayWidth(text)) + "  " + c.Description
+		}
+
+		text = truncateToWidth(text, colWidth-1)
+		padding := strings.Repeat(" ", colWidth-1-displayWidth(text))
+
+		if i == m.selected {
+			highlight(r.term)
+			fmt.Fprint(r.term, text)
+			resetDecorations(r.term)
+		} else {
+			fmt.Fprint(r.term, text)
+		}
+
+		if i < (row+1)*cols-1 {
+			fmt.Fprint(r.term, padding+" ")
+		}
+	}
+}
+
+func (r *Repl) drawMenu() {
+	m := r.menu
+	if m == nil {
+		return
+	}
+
+	w := r.getWidth()
+
+	visible := m.rows(w)
+	if visible > COMPLETION_MENU_ROWS {
+		visible = COMPLETION_MENU_ROWS
+	}
+
+	bufferHeight := r.calcHeight()
+	if r.overflow() {
+		bufferHeight = r.calcViewHeight()
+	}
+
+	if visible > r.innerHeight()-bufferHeight {
+		visible = r.innerHeight() - bufferHeight
+	}
+
+	if visible <= 0 {
+		return
+	}
+
+	// keep the selected candidate visible
+	if m.selected >= 0 {
+		selectedRow := m.selected / m.columns(w)
+
+		if selectedRow < m.offset {
+			m.offset = selectedRow
+		} else if selectedRow >= m.offset+visible {
+			m.offset = selectedRow - visible + 1
+		}
+	}
+
+	r.clearStatus()
+
+	y0 := r.reserveMenuRows(visible)
+
+	for i := 0; i < visible; i++ {
+		moveCursorTo(r.term, 0, y0+i)
+		clearRow(r.term)
+
+		r.writeMenuRow(m.offset + i)
+	}
+
+	r.writeStatus()
+}
+
+func (r *Repl) selectMenuCandidate(i int) {
+	m := r.menu
+	n := len(m.completion.Candidates)
+
+	if i < 0 {
+		i = n - 1
+	} else if i >= n {
+		i = 0
+	}
+
+	m.selected = i
+
+	m.end = r.replaceSpan(m.start, m.end, m.completion.Candidates[i].Text)
+
+	r.drawMenu()
+}
+
+// returns false if the keystroke closes the menu and must be handled as usual
+func (r *Repl) dispatchMenu(k Key) bool {
+	m := r.menu
+	cols := m.columns(r.getWidth())
+
+	switch {
+	case k.is(KEY_TAB, 0), k.is(KEY_RIGHT, 0):
+		r.selectMenuCandidate(m.selected + 1)
+	case k.is(KEY_TAB, MOD_SHIFT), k.is(KEY_LEFT, 0):
+		r.selectMenuCandidate(m.selected - 1)
+	case k.is(KEY_DOWN, 0):
+		if m.selected < 0 {
+			r.selectMenuCandidate(0)
+		} else {
+			r.selectMenuCandidate(m.selected + cols)
+		}
+	case k.is(KEY_UP, 0):
+		r.selectMenuCandidate(m.selected - cols)
+	case k.is(KEY_ENTER, 0): // RETURN accepts the selected candidate
+		r.closeMenu()
+	case k.is(KEY_ESCAPE, 0), k.isCtrl('c'): // ESC, CTRL-C restore the buffer
+		backup, backupPos := m.backup, m.backupPos
+
+		r.closeMenu()
+		r.force(backup, backupPos)
+	default:
+		r.closeMenu()
+
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,27 @@
+package repl
+
+// Returned by Loop when reading keystrokes from the terminal fails (e.g. io.EOF when stdin is closed). The terminal state is restored before Loop returns.
+type InputError struct {
+	Err error
+}
+
+func (e *InputError) Error() string {
+	return "unable to read input: " + e.Err.Error()
+}
+
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+// Returned by Loop when the size of the terminal can't be determined, or when the terminal reports a zero width or height (e.g. because the terminal was detached). The terminal state is restored before Loop returns.
+type SizeError struct {
+	Err error
+}
+
+func (e *SizeError) Error() string {
+	return "unable to get terminal size: " + e.Err.Error()
+}
+
+func (e *SizeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,38 @@
+package repl
+
+import (
+	"sync/atomic"
+)
+
+// All the Repl state is owned by the goroutine that runs Loop. Other goroutines (including the goroutine that runs Handler.Eval) post their changes as events, which are applied by Loop in between keystrokes.
+
+const (
+	_NOT_STARTED int32 = iota
+	_RUNNING
+	_STOPPED
+)
+
+func (r *Repl) running() bool {
+	return atomic.LoadInt32(&r.state) == _RUNNING
+}
+
+// run fn on the Loop goroutine, and wait for it to finish
+// fn runs directly if Loop isn't running
+func (r *Repl) do(fn func()) {
+	if !r.running() {
+		fn()
+		return
+	}
+
+	done := make(chan struct{})
+
+	select {
+	case r.events <- func() {
+		fn()
+		close(done)
+	}:
+		<-done
+	case <-r.stopped:
+		fn()
+	}
+}
@@ -27,7 +27,7 @@ func main() {
 	h := &MyHandler{}
 	h.r = repl.NewRepl(h)
 
-	if err := h.r.Loop(); err != nil {
+	if err := h.r.Loop(); err != nil && err != repl.ErrQuit {
 		log.Fatal(err)
 	}
 }
@@ -75,7 +75,7 @@ func main() {
 	h := &ShellWrapper{}
 	h.r = repl.NewRepl(h)
 
-	if err := h.r.Loop(); err != nil {
+	if err := h.r.Loop(); err != nil && err != repl.ErrQuit {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 	}
 }
@@ -1,8 +1,10 @@
 module github.com/openengineer/go-repl
 
-go 1.15
+go 1.18
 
 require (
 	github.com/openengineer/go-terminal v0.0.0-20220304032943-93486212aca4 // indirect
+	github.com/rivo/uniseg v0.4.4
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 )
@@ -1,8 +1,71 @@
 package repl
 
+import "context"
+
 // Implement this interface in order to use `Repl` with your custom logic.
 type Handler interface {
 	Prompt() string
 	Eval(buffer string) string
 	Tab(buffer string) string
 }
+
+// Optionally implement this interface in addition to `Handler`, so that a long-running evaluation can be aborted with CTRL-C.
+//
+// EvalContext is called instead of `Handler.Eval`. The REPL keeps reading keystrokes while EvalContext runs: CTRL-C cancels ctx, other keystrokes are processed after EvalContext returns.
+// This means that EvalContext can't read from stdin itself (e.g. by calling `Repl.ReadLine` or by running an interactive subprocess).
+type ContextHandler interface {
+	EvalContext(ctx context.Context, buffer string) string
+}
+
+// Optionally implement this interface in addition to `Handler`, in order to offer multiple completion candidates. Complete is called instead of `Handler.Tab`.
+//
+// pos is the byte offset of the cursor in the buffer. The first TAB inserts the single candidate, or the common prefix of all the candidates. A second TAB lists the candidates below the prompt, further TABs (or the arrow keys) cycle through them.
+type Completer interface {
+	Complete(buffer string, pos int) Completion
+}
+
+// Optionally implement this interface in addition to `Handler`, in order to confirm or sanitize pasted text (e.g. strip prompts that were copied along with the commands, or discard a large multi-line paste).
+//
+// Pasted text is inserted into the buffer as a single edit, newlines included, without evaluating anything. FilterPaste receives the pasted text with normalized newlines, and returns the text that is actually inserted. An empty string discards the paste.
+// Only terminals that support bracketed paste mode distinguish pasted text from typed text.
+type PasteFilter interface {
+	FilterPaste(text string) string
+}
+
+// Optionally implement this interface in addition to `Handler`, in order to show a secondary prompt (e.g. "... ") at the start of every line of a multi-line buffer, except the first one.
+// Without it, the lines following a newline start in the first column.
+type ContinuationPrompter interface {
+	ContinuationPrompt() string
+}
+
+// Optionally implement this interface in addition to `Handler`, in order to highlight the syntax of the buffer (e.g. keywords, strings or errors).
+//
+// Highlight is called with the entire buffer whenever it's redrawn, and returns the styled parts of the buffer. Spans shouldn't overlap, the parts of the buffer that aren't covered by a span aren't styled.
+type Highlighter interface {
+	Highlight(buffer string) []Span
+}
+
+// A styled part of the buffer, returned by `Highlighter`.
+//
+// Start and End are byte offsets in the buffer. Style contains the parameters of an SGR escape sequence, e.g. "1;34" for bold blue text, or "38;5;208" for orange text.
+type Span struct {
+	Start int
+	End   int
+	Style string
+}
+
+// Optionally implement this interface in addition to `Handler`, in order to suggest how the buffer could be completed (e.g. from the domain of the application), instead of suggesting the most recent history entry that starts with the buffer.
+//
+// Hint is called after every keystroke while the cursor is at the end of the buffer, and returns the text that would follow the buffer, or an empty string for no suggestion.
+// The suggestion is shown in grey after the cursor (see SUGGESTION_STYLE), RIGHT or END inserts the entire suggestion, CTRL-RIGHT inserts its first word.
+type Hinter interface {
+	Hint(buffer string) string
+}
+
+// Optionally implement this interface in addition to `Handler`, in order to continue incomplete input (e.g. an unclosed block or string) on the next line instead of evaluating it.
+//
+// IsComplete receives the entire buffer when RETURN is pressed. If it returns false, a newline is inserted at the cursor instead of calling `Handler.Eval`. ALT-RETURN evaluates the buffer regardless.
+// When the input isn't a terminal, lines are joined until IsComplete returns true (or until the end of the input).
+type Validator interface {
+	IsComplete(buffer string) bool
+}
@@ -0,0 +1,147 @@
+package repl
+
+import (
+	"bytes"
+	"sort"
+)
+
+// spans of the current buffer, sorted, clipped to the buffer, and snapped to grapheme boundaries
+func (r *Repl) highlightBuffer() []Span {
+	h, ok := r.handler.(Highlighter)
+	if !ok {
+		return nil
+	}
+
+	spans := make([]Span, 0)
+
+	for _, span := range h.Highlight(string(r.buffer)) {
+		if span.Style == "" {
+			continue
+		}
+
+		if span.Start < 0 {
+			span.Start = 0
+		}
+
+		if span.End > r.bufferLen() {
+			span.End = r.bufferLen()
+		}
+
+		span.Start = snapGraphemePos(r.buffer, span.Start)
+		span.End = snapGraphemePos(r.buffer, span.End)
+
+		if span.Start < span.End {
+			spans = append(spans, span)
+		}
+	}
+
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+
+	// overlapping parts are ignored
+	res := make([]Span, 0, len(spans))
+	for _, span := range spans {
+		if n := len(res); n > 0 && span.Start < res[n-1].End {
+			span.Start = res[n-1].End
+		}
+
+		if span.Start < span.End {
+			res = append(res, span)
+		}
+	}
+
+	return res
+}
+
+// style of the byte at pos, and the position where the next style starts
+func styleAt(spans []Span, pos int) (string, int) {
+	i := sort.Search(len(spans), func(i int) bool {
+		return spans[i].End > pos
+	})
+
+	if i == len(spans) {
+		return "", -1
+	} else if spans[i].Start > pos {
+		return "", spans[i].Start
+	} else {
+		return spans[i].Style, spans[i].End
+	}
+}
+
+// first position before n where the styles differ, n if the first n bytes are styled identically
+func firstStyleChange(a []Span, b []Span, n int) int {
+	pos := 0
+
+	for pos < n {
+		styleA, nextA := styleAt(a, pos)
+		styleB, nextB := styleAt(b, pos)
+
+		if styleA != styleB {
+			return pos
+		}
+
+		if nextA < 0 {
+			pos = nextB
+		} else if nextB < 0 || nextA < nextB {
+			pos = nextA
+		} else {
+			pos = nextB
+		}
+
+		if pos < 0 {
+			break
+		}
+	}
+
+	return n
+}
+
+// after text is removed from the end of the buffer, the remaining text might need a different style
+func (r *Repl) restyle() {
+	spans := r.highlightBuffer()
+
+	from := firstStyleChange(r.spans, spans, r.bufferLen())
+
+	r.spans = spans
+
+	if from < r.bufferLen() {
+		r.syncCursorTo(from)
+		r.writeBuffer(from, r.bufferLen())
+		r.syncCursor()
+	}
+}
+
+// write the part of the buffer between start and end, styled by r.spans
+func (r *Repl) writeBuffer(start, end int) {
+	for start < end {
+		style, next := styleAt(r.spans, start)
+		if next < 0 || next > end {
+			next = end
+		}
+
+		r.writeStyledBytes(r.buffer[start:next], style)
+
+		start = next
+	}
+}
+
+// newlines aren't styled, so the style doesn't leak into the continuation prompt
+func (r *Repl) writeStyledBytes(bs []byte, style string) {
+	if style == "" {
+		r.writeBytes(bs)
+		return
+	}
+
+	for i, line := range bytes.Split(bs, []byte{'\n'}) {
+		if i > 0 {
+			r.writeBytes([]byte{'\n'})
+		}
+
+		if len(line) > 0 {
+			setStyle(r.term, style)
+			r.term.Write(line)
+			resetDecorations(r.term)
+		}
+	}
+}
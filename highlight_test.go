@@ -0,0 +1,77 @@
+package repl
+
+import (
+	"reflect"
+	"testing"
+)
+
+type highlightHandler struct {
+	historyHandler
+	spans []Span
+}
+
+func (h *highlightHandler) Highlight(buffer string) []Span {
+	return h.spans
+}
+
+func TestHighlightBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer string
+		spans  []Span
+		want   []Span
+	}{
+		{"sorted", "abcdef", []Span{{4, 6, "2"}, {0, 2, "1"}}, []Span{{0, 2, "1"}, {4, 6, "2"}}},
+		{"clipped", "abcdef", []Span{{-3, 2, "1"}, {5, 100, "2"}}, []Span{{0, 2, "1"}, {5, 6, "2"}}},
+		{"out of range", "abcdef", []Span{{10, 20, "1"}, {-5, -1, "2"}, {4, 2, "3"}}, []Span{}},
+		{"without style", "abcdef", []Span{{0, 2, ""}}, []Span{}},
+		// the first span wins
+		{"overlapping", "abcdef", []Span{{0, 4, "1"}, {2, 6, "2"}, {1, 3, "3"}}, []Span{{0, 4, "1"}, {4, 6, "2"}}},
+		// rounded up to the end of the wide character at bytes 2 to 5
+		{"inside a character", "ab世cd", []Span{{0, 3, "1"}, {3, 4, "2"}, {4, 7, "3"}}, []Span{{0, 5, "1"}, {5, 7, "3"}}},
+		{"combining accent", "e\u0301x", []Span{{0, 1, "1"}, {1, 4, "2"}}, []Span{{0, 3, "1"}, {3, 4, "2"}}},
+	}
+
+	for _, test := range tests {
+		r := NewTerminalRepl(&highlightHandler{historyHandler{}, test.spans}, nil)
+		r.buffer = []byte(test.buffer)
+
+		if got := r.highlightBuffer(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+
+	// nil without Highlighter
+	r := NewTerminalRepl(&historyHandler{}, nil)
+	r.buffer = []byte("abc")
+
+	if got := r.highlightBuffer(); got != nil {
+		t.Errorf("expected no spans without Highlighter, got %v", got)
+	}
+}
+
+func TestFirstStyleChange(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []Span
+		b    []Span
+		n    int
+		want int
+	}{
+		{"unstyled", nil, nil, 6, 6},
+		{"identical", []Span{{1, 3, "1"}}, []Span{{1, 3, "1"}}, 6, 6},
+		{"new span", nil, []Span{{2, 4, "1"}}, 6, 2},
+		{"removed span", []Span{{2, 4, "1"}}, nil, 6, 2},
+		{"different style", []Span{{0, 4, "1"}}, []Span{{0, 4, "2"}}, 6, 0},
+		{"shorter span", []Span{{0, 5, "1"}}, []Span{{0, 3, "1"}}, 6, 3},
+		{"split span", []Span{{0, 4, "1"}}, []Span{{0, 2, "1"}, {2, 4, "1"}}, 6, 6},
+		// only the first n bytes are compared
+		{"change after n", []Span{{0, 2, "1"}}, []Span{{0, 2, "1"}, {4, 6, "2"}}, 4, 4},
+	}
+
+	for _, test := range tests {
+		if got := firstStyleChange(test.a, test.b, test.n); got != test.want {
+			t.Errorf("%s: expected %d, got %d", test.name, test.want, got)
+		}
+	}
+}
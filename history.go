@@ -0,0 +1,174 @@
+package repl
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Each history entry is stored on a single line of the history file.
+// Newlines inside entries (inserted with SHIFT-ENTER) are escaped as `\n`, and backslashes as `\\`.
+func encodeHistoryEntry(entry []byte) string {
+	var sb strings.Builder
+
+	for _, c := range entry {
+		switch c {
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	sb.WriteByte('\n')
+
+	return sb.String()
+}
+
+func decodeHistoryEntry(line string) []byte {
+	entry := make([]byte, 0, len(line))
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		if c == '\\' && i < len(line)-1 {
+			i++
+
+			switch line[i] {
+			case 'n':
+				entry = append(entry, '\n')
+			case 'r':
+				entry = append(entry, '\r')
+			default:
+				entry = append(entry, line[i])
+			}
+		} else {
+			entry = append(entry, c)
+		}
+	}
+
+	return entry
+}
+
+// read all the entries of an existing history file, a missing file is not an error
+func readHistoryFile(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	entries := make([][]byte, 0)
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+
+		line = strings.TrimSuffix(line, "\n")
+		if line != "" {
+			entries = append(entries, decodeHistoryEntry(line))
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// load the prior entries and keep the file open for appending
+func (r *Repl) openHistory() error {
+	if r.historyPath == "" || r.historyFile != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(r.historyDir, 0700); err != nil {
+		return err
+	}
+
+	entries, err := readHistoryFile(r.historyPath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(r.historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	// the entries of a previous history file are replaced, those that weren't saved in any file are kept
+	r.history = append(entries, r.unsaved...)
+	r.historyFile = f
+
+	if r.historyIdx >= len(r.history) {
+		r.historyIdx = -1
+	}
+
+	return nil
+}
+
+func (r *Repl) writeHistoryEntry(entry []byte) {
+	if len(entry) == 0 {
+		return
+	} else if r.historyFile == nil {
+		r.unsaved = append(r.unsaved, entry)
+		return
+	}
+
+	if _, err := r.historyFile.WriteString(encodeHistoryEntry(entry)); err != nil {
+		r.log("failed to write history entry: %v\n", err)
+	}
+}
+
+func (r *Repl) closeHistory() {
+	if r.historyFile == nil {
+		return
+	}
+
+	if err := r.historyFile.Sync(); err != nil {
+		r.log("failed to sync history file: %v\n", err)
+	}
+
+	if err := r.historyFile.Close(); err != nil {
+		r.log("failed to close history file: %v\n", err)
+	}
+
+	r.historyFile = nil
+}
+
+// Persist the history in the given file. Entries already in the file are loaded when Loop starts, and every evaluated entry is appended to it.
+// If Loop is already running, the entries of the previous history file are replaced by those of the new file.
+//
+// The parent directory is created if it doesn't exist yet. An empty path disables persistence.
+func (r *Repl) SetHistoryFile(path string) {
+	r.do(func() {
+		r.closeHistory()
+
+		if path == "" {
+			r.historyDir = ""
+			r.historyPath = ""
+		} else {
+			r.historyDir = filepath.Dir(path)
+			r.historyPath = path
+		}
+
+		// otherwise the history file is opened when Loop starts
+		if r.running() {
+			if err := r.openHistory(); err != nil {
+				r.log("failed to open history file: %v\n", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package repl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type historyHandler struct{}
+
+func (h *historyHandler) Prompt() string {
+	return "> "
+}
+
+func (h *historyHandler) Eval(buffer string) string {
+	return ""
+}
+
+func (h *historyHandler) Tab(buffer string) string {
+	return ""
+}
+
+func TestHistoryEntryRoundtrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		encoded string
+	}{
+		{"plain", "abc", "abc\n"},
+		{"backslash", `a\b`, `a\\b` + "\n"},
+		{"newline", "a\nb", `a\nb` + "\n"},
+		{"carriage return", "a\r\nb", `a\r\nb` + "\n"},
+		{"escaped sequence", `a\nb`, `a\\nb` + "\n"},
+		{"trailing backslash", `a\`, `a\\` + "\n"},
+		{"only escapes", "\\\n\r", `\\\n\r` + "\n"},
+	}
+
+	for _, test := range tests {
+		encoded := encodeHistoryEntry([]byte(test.entry))
+		if encoded != test.encoded {
+			t.Errorf("%s: expected %q, got %q", test.name, test.encoded, encoded)
+		}
+
+		if decoded := decodeHistoryEntry(encoded[0 : len(encoded)-1]); string(decoded) != test.entry {
+			t.Errorf("%s: expected %q after decoding, got %q", test.name, test.entry, decoded)
+		}
+	}
+}
+
+func TestReopenHistory(t *testing.T) {
+	dir := t.TempDir()
+
+	pathA := filepath.Join(dir, "a")
+	pathB := filepath.Join(dir, "b")
+
+	if err := os.WriteFile(pathA, []byte("a1\na2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(pathB, []byte("b1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewTerminalRepl(&historyHandler{}, nil)
+	defer r.closeHistory()
+
+	// evaluated before a history file is set
+	r.appendToHistory([]byte("x"))
+
+	open := func(path string) {
+		r.closeHistory()
+		r.historyDir, r.historyPath = filepath.Dir(path), path
+
+		if err := r.openHistory(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open(pathA)
+	r.appendToHistory([]byte("a3"))
+	assertHistory(t, r, "a1", "a2", "x", "a3")
+
+	// reopening the same file doesn't duplicate its entries
+	open(pathA)
+	assertHistory(t, r, "a1", "a2", "a3", "x")
+
+	open(pathB)
+	assertHistory(t, r, "b1", "x")
+}
+
+func assertHistory(t *testing.T, r *Repl, entries ...string) {
+	t.Helper()
+
+	got := make([]string, len(r.history))
+	for i, entry := range r.history {
+		got[i] = string(entry)
+	}
+
+	if len(got) != len(entries) {
+		t.Errorf("expected history %q, got %q", entries, got)
+		return
+	}
+
+	for i := range entries {
+		if got[i] != entries[i] {
+			t.Errorf("expected history %q, got %q", entries, got)
+			return
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package repl
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// A lone ESC byte is reported as the ESC key if it isn't followed by the rest of an escape sequence within this time.
+	// Increase this for slow connections, where escape sequences can be split over several reads.
+	ESCAPE_TIMEOUT = 50 * time.Millisecond
+)
+
+// Identifies the key of a Key event.
+type KeyCode int
+
+const (
+	KEY_NONE KeyCode = iota
+	KEY_RUNE         // printable character, or a character combined with MOD_CTRL or MOD_ALT
+	KEY_ENTER
+	KEY_TAB
+	KEY_BACKSPACE
+	KEY_ESCAPE
+	KEY_INSERT
+	KEY_DELETE
+	KEY_UP
+	KEY_DOWN
+	KEY_RIGHT
+	KEY_LEFT
+	KEY_HOME
+	KEY_END
+	KEY_PAGE_UP
+	KEY_PAGE_DOWN
+	KEY_F1
+	KEY_F2
+	KEY_F3
+	KEY_F4
+	KEY_F5
+	KEY_F6
+	KEY_F7
+	KEY_F8
+	KEY_F9
+	KEY_F10
+	KEY_F11
+	KEY_F12
+
+	keyCursorPos  // answer to a cursor position query
+	keyPasteStart // start of bracketed paste, the pasted text is collected by _KeyParser
+	keyPaste      // the complete pasted text
+)
+
+const _PASTE_END = "\033[201~"
+
+// Modifier keys held down, combined as bit flags.
+type Modifier int
+
+const (
+	MOD_SHIFT Modifier = 1 << iota
+	MOD_ALT
+	MOD_CTRL
+)
+
+// A decoded keystroke.
+type Key struct {
+	Code KeyCode
+	Rune rune // only for KEY_RUNE, control characters are decoded as lower case letters combined with MOD_CTRL (e.g. CTRL-A is 'a')
+	Mod  Modifier
+
+	row int // only for keyCursorPos (0-based)
+	col int
+
+	text string // only for keyPaste
+}
+
+var keyNames = map[KeyCode]string{
+	KEY_ENTER:     "enter",
+	KEY_TAB:       "tab",
+	KEY_BACKSPACE: "backspace",
+	KEY_ESCAPE:    "esc",
+	KEY_INSERT:    "insert",
+	KEY_DELETE:    "delete",
+	KEY_UP:        "up",
+	KEY_DOWN:      "down",
+	KEY_RIGHT:     "right",
+	KEY_LEFT:      "left",
+	KEY_HOME:      "home",
+	KEY_END:       "end",
+	KEY_PAGE_UP:   "pgup",
+	KEY_PAGE_DOWN: "pgdown",
+	KEY_F1:        "f1",
+	KEY_F2:        "f2",
+	KEY_F3:        "f3",
+	KEY_F4:        "f4",
+	KEY_F5:        "f5",
+	KEY_F6:        "f6",
+	KEY_F7:        "f7",
+	KEY_F8:        "f8",
+	KEY_F9:        "f9",
+	KEY_F10:       "f10",
+	KEY_F11:       "f11",
+	KEY_F12:       "f12",
+}
+
+// Returns a readable name of the key, e.g. "ctrl-a", "alt-f", "shift-tab" or "f1".
+func (k Key) String() string {
+	var sb strings.Builder
+
+	if k.Mod&MOD_CTRL != 0 {
+		sb.WriteString("ctrl-")
+	}
+
+	if k.Mod&MOD_ALT != 0 {
+		sb.WriteString("alt-")
+	}
+
+	if k.Mod&MOD_SHIFT != 0 {
+		sb.WriteString("shift-")
+	}
+
+	switch k.Code {
+	case KEY_RUNE:
+		if k.Rune == ' ' {
+			sb.WriteString("space")
+		} else if k.Rune == '-' {
+			sb.WriteString("minus")
+		} else {
+			sb.WriteRune(k.Rune)
+		}
+	case keyCursorPos:
+		sb.WriteString("cursor-pos")
+	case keyPaste:
+		sb.WriteString("paste")
+	default:
+		if name, ok := keyNames[k.Code]; ok {
+			sb.WriteString(name)
+		} else {
+			sb.WriteString("none")
+		}
+	}
+
+	return sb.String()
+}
+
+// true for printable characters without modifiers (SHIFT is implied by the character itself)
+func (k Key) isText() bool {
+	return k.Code == KEY_RUNE && k.Mod&(MOD_CTRL|MOD_ALT) == 0
+}
+
+func (k Key) is(code KeyCode, mod Modifier) bool {
+	return k.Code == code && k.Mod == mod
+}
+
+func (k Key) isCtrl(c rune) bool {
+	return k.Code == KEY_RUNE && k.Mod == MOD_CTRL && k.Rune == c
+}
+
+// _KeyParser is a VT input state machine, that turns the raw terminal input into Key events.
+// Escape sequences can be split over several reads, so incomplete input is kept until more bytes arrive, or until flush is called after ESCAPE_TIMEOUT.
+// Pasted text isn't decoded, it is collected until the end of the bracketed paste, no matter how long that takes.
+type _KeyParser struct {
+	buf     []byte
+	pasting bool
+	paste   []byte
+}
+
+func newKeyParser() *_KeyParser {
+	return &_KeyParser{
+		buf:     make([]byte, 0),
+		pasting: false,
+		paste:   make([]byte, 0),
+	}
+}
+
+func (p *_KeyParser) feed(b []byte) []Key {
+	p.buf = append(p.buf, b...)
+
+	return p.parse(false)
+}
+
+// true if an incomplete sequence is waiting for more bytes
+func (p *_KeyParser) pending() bool {
+	return !p.pasting && len(p.buf) > 0
+}
+
+// no more bytes are expected, so a lone ESC is the ESC key
+func (p *_KeyParser) flush() []Key {
+	return p.parse(true)
+}
+
+func (p *_KeyParser) parse(final bool) []Key {
+	keys := make([]Key, 0)
+
+	for len(p.buf) > 0 {
+		if p.pasting {
+			if !p.collectPaste() {
+				break
+			}
+
+			keys = append(keys, Key{Code: keyPaste, text: string(p.paste)})
+
+			p.pasting = false
+			p.paste = make([]byte, 0)
+			continue
+		}
+
+		k, n := parseKey(p.buf, final)
+		if n == 0 {
+			break
+		}
+
+		p.buf = p.buf[n:]
+
+		if k.Code == keyPasteStart {
+			p.pasting = true
+		} else if k.Code != KEY_NONE {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(p.buf) == 0 {
+		p.buf = make([]byte, 0)
+	}
+
+	return keys
+}
+
+// returns true once the end of the paste is reached
+func (p *_KeyParser) collectPaste() bool {
+	i := bytes.Index(p.buf, []byte(_PASTE_END))
+
+	if i < 0 {
+		// keep the bytes that might be the start of the end sequence
+		n := len(p.buf) - (len(_PASTE_END) - 1)
+		if n > 0 {
+			p.paste = append(p.paste, p.buf[0:n]...)
+			p.buf = p.buf[n:]
+		}
+
+		return false
+	}
+
+	p.paste = append(p.paste, p.buf[0:i]...)
+	p.buf = p.buf[i+len(_PASTE_END):]
+
+	return true
+}
+
+// returns the key and the number of bytes it uses, or 0 bytes if b is incomplete
+// if final, incomplete input is decoded as well as possible
+func parseKey(b []byte, final bool) (Key, int) {
+	c := b[0]
+
+	switch {
+	case c == 27:
+		return parseEscape(b, final)
+	case c == 9:
+		return Key{Code: KEY_TAB}, 1
+	case c == 13:
+		return Key{Code: KEY_ENTER}, 1
+	case c == 127:
+		return Key{Code: KEY_BACKSPACE}, 1
+	case c == 0:
+		return Key{Code: KEY_RUNE, Rune: ' ', Mod: MOD_CTRL}, 1
+	case c < 27:
+		return Key{Code: KEY_RUNE, Rune: rune('a' + c - 1), Mod: MOD_CTRL}, 1
+	case c < 32:
+		return Key{Code: KEY_RUNE, Rune: rune("\\]^_"[c-28]), Mod: MOD_CTRL}, 1
+	case c < 128:
+		return Key{Code: KEY_RUNE, Rune: rune(c)}, 1
+	default:
+		if !utf8.FullRune(b) {
+			if final {
+				return Key{}, 1 // drop the invalid byte
+			}
+
+			return Key{}, 0
+		}
+
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size <= 1 {
+			return Key{}, 1
+		}
+
+		return Key{Code: KEY_RUNE, Rune: r}, size
+	}
+}
+
+func parseEscape(b []byte, final bool) (Key, int) {
+	if len(b) == 1 {
+		if final {
+			return Key{Code: KEY_ESCAPE}, 1
+		}
+
+		return Key{}, 0
+	}
+
+	switch b[1] {
+	case '[':
+		return parseCSI(b, final)
+	case 'O':
+		if len(b) == 2 {
+			if final {
+				return Key{Code: KEY_RUNE, Rune: 'O', Mod: MOD_ALT}, 2
+			}
+
+			return Key{}, 0
+		}
+
+		return parseSS3(b[2]), 3
+	case 27:
+		return Key{Code: KEY_ESCAPE}, 1
+	default:
+		// ALT + KEY is sent as ESC followed by the key
+		k, n := parseKey(b[1:], final)
+		if n == 0 {
+			return Key{}, 0
+		}
+
+		k.Mod |= MOD_ALT
+
+		return k, n + 1
+	}
+}
+
+func parseSS3(c byte) Key {
+	switch c {
+	case 'A':
+		return Key{Code: KEY_UP}
+	case 'B':
+		return Key{Code: KEY_DOWN}
+	case 'C':
+		return Key{Code: KEY_RIGHT}
+	case 'D':
+		return Key{Code: KEY_LEFT}
+	case 'H':
+		return Key{Code: KEY_HOME}
+	case 'F':
+		return Key{Code: KEY_END}
+	case 'M':
+		return Key{Code: KEY_ENTER}
+	case 'P':
+		return Key{Code: KEY_F1}
+	case 'Q':
+		return Key{Code: KEY_F2}
+	case 'R':
+		return Key{Code: KEY_F3}
+	case 'S':
+		return Key{Code: KEY_F4}
+	default:
+		return Key{}
+	}
+}
+
+// xterm encodes the modifiers as 1 + bit flags (1: shift, 2: alt, 4: ctrl, 8: meta)
+func parseModifier(param int) Modifier {
+	bits := param - 1
+	if bits <= 0 {
+		return 0
+	}
+
+	var mod Modifier
+
+	if bits&1 != 0 {
+		mod |= MOD_SHIFT
+	}
+
+	if bits&(2|8) != 0 {
+		mod |= MOD_ALT
+	}
+
+	if bits&4 != 0 {
+		mod |= MOD_CTRL
+	}
+
+	return mod
+}
+
+// the unicode code point of CSI u and CSI 27 ~ sequences
+func codePointKey(cp int, mod Modifier) Key {
+	switch cp {
+	case 13:
+		return Key{Code: KEY_ENTER, Mod: mod}
+	case 9:
+		return Key{Code: KEY_TAB, Mod: mod}
+	case 27:
+		return Key{Code: KEY_ESCAPE, Mod: mod}
+	case 8, 127:
+		return Key{Code: KEY_BACKSPACE, Mod: mod}
+	default:
+		if cp < 32 || !utf8.ValidRune(rune(cp)) {
+			return Key{}
+		}
+
+		return Key{Code: KEY_RUNE, Rune: rune(cp), Mod: mod}
+	}
+}
+
+var tildeKeys = map[int]KeyCode{
+	1:  KEY_HOME,
+	2:  KEY_INSERT,
+	3:  KEY_DELETE,
+	4:  KEY_END,
+	5:  KEY_PAGE_UP,
+	6:  KEY_PAGE_DOWN,
+	7:  KEY_HOME,
+	8:  KEY_END,
+	11: KEY_F1,
+	12: KEY_F2,
+	13: KEY_F3,
+	14: KEY_F4,
+	15: KEY_F5,
+	17: KEY_F6,
+	18: KEY_F7,
+	19: KEY_F8,
+	20: KEY_F9,
+	21: KEY_F10,
+	23: KEY_F11,
+	24: KEY_F12,
+}
+
+// ESC [ <parameter bytes> <intermediate bytes> <final byte>
+func parseCSI(b []byte, final bool) (Key, int) {
+	i := 2
+	for i < len(b) && b[i] >= 0x20 && b[i] <= 0x3f {
+		i++
+	}
+
+	if i == len(b) {
+		if final {
+			return Key{Code: KEY_RUNE, Rune: '[', Mod: MOD_ALT}, 2
+		}
+
+		return Key{}, 0
+	} else if b[i] < 0x40 || b[i] > 0x7e {
+		// malformed
+		return Key{Code: KEY_RUNE, Rune: '[', Mod: MOD_ALT}, 2
+	}
+
+	n := i + 1
+	params := string(b[2:i])
+	fin := b[i]
+
+	if len(params) > 0 && strings.ContainsAny(params[0:1], "<=>?") {
+		// private sequences (e.g. mouse reports) aren't supported
+		return Key{}, n
+	}
+
+	ps := make([]int, 0)
+	if params != "" {
+		for _, p := range strings.Split(params, ";") {
+			// sub-parameters (e.g. kitty's shifted keys) are ignored
+			p = strings.SplitN(p, ":", 2)[0]
+
+			v, err := strconv.Atoi(p)
+			if err != nil {
+				v = 0
+			}
+
+			ps = append(ps, v)
+		}
+	}
+
+	param := func(j int, def int) int {
+		if j < len(ps) && ps[j] != 0 {
+			return ps[j]
+		}
+
+		return def
+	}
+
+	mod := parseModifier(param(1, 1))
+
+	switch fin {
+	case 'A':
+		return Key{Code: KEY_UP, Mod: mod}, n
+	case 'B':
+		return Key{Code: KEY_DOWN, Mod: mod}, n
+	case 'C':
+		return Key{Code: KEY_RIGHT, Mod: mod}, n
+	case 'D':
+		return Key{Code: KEY_LEFT, Mod: mod}, n
+	case 'H':
+		return Key{Code: KEY_HOME, Mod: mod}, n
+	case 'F':
+		return Key{Code: KEY_END, Mod: mod}, n
+	case 'Z':
+		return Key{Code: KEY_TAB, Mod: MOD_SHIFT}, n
+	case 'P':
+		return Key{Code: KEY_F1, Mod: mod}, n
+	case 'Q':
+		return Key{Code: KEY_F2, Mod: mod}, n
+	case 'R':
+		if len(ps) == 2 {
+			// also used for F3 with modifiers, see Repl.dispatch
+			return Key{Code: keyCursorPos, Mod: mod, row: param(0, 1) - 1, col: param(1, 1) - 1}, n
+		}
+
+		return Key{Code: KEY_F3, Mod: mod}, n
+	case 'S':
+		return Key{Code: KEY_F4, Mod: mod}, n
+	case 'u':
+		return codePointKey(param(0, 0), mod), n
+	case '~':
+		if param(0, 0) == 27 {
+			// xterm modifyOtherKeys: CSI 27 ; mod ; code ~
+			return codePointKey(param(2, 0), mod), n
+		}
+
+		if param(0, 0) == 200 {
+			return Key{Code: keyPasteStart}, n
+		}
+
+		if code, ok := tildeKeys[param(0, 0)]; ok {
+			return Key{Code: code, Mod: mod}, n
+		}
+	}
+
+	return Key{}, n
+}
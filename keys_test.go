@@ -0,0 +1,156 @@
+package repl
+
+import (
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		keys  []Key
+	}{
+		{"printable", "a", []Key{{Code: KEY_RUNE, Rune: 'a'}}},
+		{"multi-byte", "é世", []Key{{Code: KEY_RUNE, Rune: 'é'}, {Code: KEY_RUNE, Rune: '世'}}},
+		{"enter", "\r", []Key{{Code: KEY_ENTER}}},
+		{"tab", "\t", []Key{{Code: KEY_TAB}}},
+		{"backspace", "\x7f", []Key{{Code: KEY_BACKSPACE}}},
+		{"ctrl-a", "\x01", []Key{{Code: KEY_RUNE, Rune: 'a', Mod: MOD_CTRL}}},
+		{"ctrl-j", "\n", []Key{{Code: KEY_RUNE, Rune: 'j', Mod: MOD_CTRL}}},
+		{"ctrl-space", "\x00", []Key{{Code: KEY_RUNE, Rune: ' ', Mod: MOD_CTRL}}},
+		{"ctrl-underscore", "\x1f", []Key{{Code: KEY_RUNE, Rune: '_', Mod: MOD_CTRL}}},
+		{"alt-b", "\033b", []Key{{Code: KEY_RUNE, Rune: 'b', Mod: MOD_ALT}}},
+		{"alt-enter", "\033\r", []Key{{Code: KEY_ENTER, Mod: MOD_ALT}}},
+		{"alt-ctrl-a", "\033\x01", []Key{{Code: KEY_RUNE, Rune: 'a', Mod: MOD_CTRL | MOD_ALT}}},
+		{"up", "\033[A", []Key{{Code: KEY_UP}}},
+		{"ss3 up", "\033OA", []Key{{Code: KEY_UP}}},
+		{"ss3 f1", "\033OP", []Key{{Code: KEY_F1}}},
+		{"ss3 f3", "\033OR", []Key{{Code: KEY_F3}}},
+		{"home", "\033[H", []Key{{Code: KEY_HOME}}},
+		{"vt home", "\033[1~", []Key{{Code: KEY_HOME}}},
+		{"end", "\033[F", []Key{{Code: KEY_END}}},
+		{"vt end", "\033[4~", []Key{{Code: KEY_END}}},
+		{"delete", "\033[3~", []Key{{Code: KEY_DELETE}}},
+		{"page up", "\033[5~", []Key{{Code: KEY_PAGE_UP}}},
+		{"f12", "\033[24~", []Key{{Code: KEY_F12}}},
+		{"shift-tab", "\033[Z", []Key{{Code: KEY_TAB, Mod: MOD_SHIFT}}},
+		{"shift-right", "\033[1;2C", []Key{{Code: KEY_RIGHT, Mod: MOD_SHIFT}}},
+		{"alt-up", "\033[1;3A", []Key{{Code: KEY_UP, Mod: MOD_ALT}}},
+		{"ctrl-left", "\033[1;5D", []Key{{Code: KEY_LEFT, Mod: MOD_CTRL}}},
+		{"ctrl-shift-end", "\033[1;6F", []Key{{Code: KEY_END, Mod: MOD_CTRL | MOD_SHIFT}}},
+		{"meta-down", "\033[1;9B", []Key{{Code: KEY_DOWN, Mod: MOD_ALT}}},
+		{"ctrl-delete", "\033[3;5~", []Key{{Code: KEY_DELETE, Mod: MOD_CTRL}}},
+		{"csi u shift-enter", "\033[13;2u", []Key{{Code: KEY_ENTER, Mod: MOD_SHIFT}}},
+		{"csi u ctrl-a", "\033[97;5u", []Key{{Code: KEY_RUNE, Rune: 'a', Mod: MOD_CTRL}}},
+		{"csi u escape", "\033[27u", []Key{{Code: KEY_ESCAPE}}},
+		{"csi u sub-parameter", "\033[97:65;2u", []Key{{Code: KEY_RUNE, Rune: 'a', Mod: MOD_SHIFT}}},
+		{"modifyOtherKeys ctrl-i", "\033[27;5;105~", []Key{{Code: KEY_RUNE, Rune: 'i', Mod: MOD_CTRL}}},
+		{"modifyOtherKeys shift-enter", "\033[27;2;13~", []Key{{Code: KEY_ENTER, Mod: MOD_SHIFT}}},
+		// CSI 1;<mod>R is also F3 with modifiers, so the column of a cursor position report is decoded as a modifier too, Repl.dispatch turns a report that wasn't requested into F3 with that modifier
+		{"cursor position", "\033[12;5R", []Key{{Code: keyCursorPos, Mod: MOD_CTRL, row: 11, col: 4}}},
+		{"f3", "\033[R", []Key{{Code: KEY_F3}}},
+		{"ctrl-f3 as cursor position", "\033[1;5R", []Key{{Code: keyCursorPos, Mod: MOD_CTRL, row: 0, col: 4}}},
+		{"mouse report", "\033[<0;1;1Mx", []Key{{Code: KEY_RUNE, Rune: 'x'}}},
+		{"unknown tilde", "\033[99~x", []Key{{Code: KEY_RUNE, Rune: 'x'}}},
+		{"malformed csi", "\033[1\x01", []Key{{Code: KEY_RUNE, Rune: '[', Mod: MOD_ALT}, {Code: KEY_RUNE, Rune: '1'}, {Code: KEY_RUNE, Rune: 'a', Mod: MOD_CTRL}}},
+		{"invalid utf-8", "\xffa", []Key{{Code: KEY_RUNE, Rune: 'a'}}},
+		{"sequence", "ab\033[Dc", []Key{{Code: KEY_RUNE, Rune: 'a'}, {Code: KEY_RUNE, Rune: 'b'}, {Code: KEY_LEFT}, {Code: KEY_RUNE, Rune: 'c'}}},
+		{"paste", "\033[200~a\033[Ab\r\033[201~c", []Key{{Code: keyPaste, text: "a\033[Ab\r"}, {Code: KEY_RUNE, Rune: 'c'}}},
+	}
+
+	for _, test := range tests {
+		p := newKeyParser()
+
+		keys := p.feed([]byte(test.input))
+
+		if !equalKeys(keys, test.keys) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.keys, keys)
+		}
+
+		if p.pending() {
+			t.Errorf("%s: unexpected pending input %q", test.name, p.buf)
+		}
+	}
+}
+
+// the input is split over several reads, flush is called if a read is nil
+func TestParseSplitKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		reads []string
+		keys  []Key
+	}{
+		{"lone esc", []string{"\033", ""}, []Key{{Code: KEY_ESCAPE}}},
+		{"esc then csi", []string{"\033", "[A"}, []Key{{Code: KEY_UP}}},
+		{"csi split", []string{"\033[1;", "5C"}, []Key{{Code: KEY_RIGHT, Mod: MOD_CTRL}}},
+		{"ss3 split", []string{"\033O", "B"}, []Key{{Code: KEY_DOWN}}},
+		{"incomplete ss3", []string{"\033O", ""}, []Key{{Code: KEY_RUNE, Rune: 'O', Mod: MOD_ALT}}},
+		{"incomplete csi", []string{"\033[", ""}, []Key{{Code: KEY_RUNE, Rune: '[', Mod: MOD_ALT}}},
+		{"incomplete csi with params", []string{"\033[1;5", ""}, []Key{{Code: KEY_RUNE, Rune: '[', Mod: MOD_ALT}, {Code: KEY_RUNE, Rune: '1'}, {Code: KEY_RUNE, Rune: ';'}, {Code: KEY_RUNE, Rune: '5'}}},
+		{"double esc", []string{"\033\033", ""}, []Key{{Code: KEY_ESCAPE}, {Code: KEY_ESCAPE}}},
+		{"alt split", []string{"\033", "x"}, []Key{{Code: KEY_RUNE, Rune: 'x', Mod: MOD_ALT}}},
+		{"utf-8 split", []string{"\xe4\xb8", "\x96"}, []Key{{Code: KEY_RUNE, Rune: '世'}}},
+		{"incomplete utf-8", []string{"\xe4\xb8", "", "a"}, []Key{{Code: KEY_RUNE, Rune: 'a'}}},
+		// the column is decoded as a modifier too, see TestParseKeys
+		{"cursor position split", []string{"\033[3", ";7R"}, []Key{{Code: keyCursorPos, Mod: MOD_ALT | MOD_CTRL, row: 2, col: 6}}},
+		{"paste end split", []string{"\033[200~ab\033[20", "1~"}, []Key{{Code: keyPaste, text: "ab"}}},
+		{"paste start split", []string{"\033[20", "0~ab", "", "\033[201~"}, []Key{{Code: keyPaste, text: "ab"}}},
+	}
+
+	for _, test := range tests {
+		p := newKeyParser()
+
+		keys := make([]Key, 0)
+
+		for _, read := range test.reads {
+			if read == "" {
+				keys = append(keys, p.flush()...)
+			} else {
+				keys = append(keys, p.feed([]byte(read))...)
+			}
+		}
+
+		if !equalKeys(keys, test.keys) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.keys, keys)
+		}
+
+		if p.pending() {
+			t.Errorf("%s: unexpected pending input %q", test.name, p.buf)
+		}
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	tests := []struct {
+		key  Key
+		name string
+	}{
+		{Key{Code: KEY_RUNE, Rune: 'a', Mod: MOD_CTRL}, "ctrl-a"},
+		{Key{Code: KEY_RUNE, Rune: 'f', Mod: MOD_ALT}, "alt-f"},
+		{Key{Code: KEY_RUNE, Rune: ' ', Mod: MOD_CTRL}, "ctrl-space"},
+		{Key{Code: KEY_RUNE, Rune: '-', Mod: MOD_ALT}, "alt-minus"},
+		{Key{Code: KEY_TAB, Mod: MOD_SHIFT}, "shift-tab"},
+		{Key{Code: KEY_LEFT, Mod: MOD_CTRL | MOD_ALT | MOD_SHIFT}, "ctrl-alt-shift-left"},
+		{Key{Code: KEY_F1}, "f1"},
+	}
+
+	for _, test := range tests {
+		if s := test.key.String(); s != test.name {
+			t.Errorf("expected %q, got %q", test.name, s)
+		}
+	}
+}
+
+func equalKeys(a, b []Key) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
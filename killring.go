@@ -0,0 +1,85 @@
+package repl
+
+var (
+	// Maximum number of deletions kept in the kill ring, the oldest deletion is dropped when the ring is full.
+	KILL_RING_SIZE = 30
+)
+
+// consecutive kills are appended to the same kill ring entry
+var killActions = map[string]bool{
+	"clearToEnd":          true,
+	"clearToStart":        true,
+	"clearOnePhraseLeft":  true,
+	"clearOnePhraseRight": true,
+}
+
+// add deleted text to the kill ring, backward deletions are prepended when appending to the previous kill
+func (r *Repl) kill(text []byte, backward bool) {
+	if len(text) == 0 {
+		return
+	}
+
+	text = copyBytes(text)
+
+	n := len(r.killRing)
+	if n > 0 && killActions[r.action] && killActions[r.prevAction] {
+		if backward {
+			r.killRing[n-1] = append(text, r.killRing[n-1]...)
+		} else {
+			r.killRing[n-1] = append(r.killRing[n-1], text...)
+		}
+
+		return
+	}
+
+	r.killRing = append(r.killRing, text)
+
+	if len(r.killRing) > KILL_RING_SIZE && KILL_RING_SIZE > 0 {
+		r.killRing = r.killRing[len(r.killRing)-KILL_RING_SIZE:]
+	}
+}
+
+// most recent kill, nil if nothing was killed yet
+func (r *Repl) lastKill() []byte {
+	n := len(r.killRing)
+	if n == 0 {
+		return nil
+	}
+
+	return r.killRing[n-1]
+}
+
+// insert the most recent kill, and remember where, so it can be replaced by yankPop
+func (r *Repl) insertPrevDel() {
+	text := r.lastKill()
+	if text == nil {
+		r.action = ""
+		return
+	}
+
+	r.yankIdx = len(r.killRing) - 1
+	r.yankStart = r.bufferPos
+
+	r.addBytesToBuffer(text)
+
+	r.yankEnd = r.bufferPos
+}
+
+// replace the text that was just yanked by the previous kill in the ring
+func (r *Repl) yankPop() {
+	n := len(r.killRing)
+
+	if (r.prevAction != "insertPrevDel" && r.prevAction != "yankPop") || n == 0 {
+		// only directly after a yank
+		r.action = ""
+		return
+	} else if r.yankStart > r.yankEnd || r.yankEnd > r.bufferLen() {
+		// the yanked span is no longer part of the buffer
+		r.action = ""
+		return
+	}
+
+	r.yankIdx = (r.yankIdx - 1 + n) % n
+
+	r.yankEnd = r.replaceSpan(r.yankStart, r.yankEnd, string(r.killRing[r.yankIdx]))
+}
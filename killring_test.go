@@ -0,0 +1,104 @@
+package repl_test
+
+import (
+	"testing"
+
+	repl "github.com/openengineer/go-repl"
+	"github.com/openengineer/go-repl/repltest"
+)
+
+const ALT_Y = "\033y"
+
+func TestKillAndYank(t *testing.T) {
+	h := start(&echoHandler{}, 40, 5)
+
+	h.Type("hello big world")
+
+	// consecutive kills are joined into a single kill ring entry, words and spaces are separate phrases
+	h.Keys(repltest.CTRL_W, repltest.CTRL_W, repltest.CTRL_W)
+	assertRows(t, h, "> hello")
+	assertCursor(t, h, 8, 0)
+
+	h.Keys(repltest.CTRL_Y)
+	assertRows(t, h, "> hello big world")
+	assertCursor(t, h, 17, 0)
+
+	// killing forward
+	h.Keys(repltest.CTRL_A, repltest.CTRL_K)
+	assertRows(t, h, ">")
+
+	h.Keys(repltest.CTRL_Y, repltest.CTRL_Y)
+	assertRows(t, h, "> hello big worldhello big world")
+}
+
+func TestYankPop(t *testing.T) {
+	h := start(&echoHandler{}, 30, 5)
+
+	// the kills are separated by typing, so they end up in separate entries
+	h.Type("one")
+	h.Keys(repltest.CTRL_W)
+	h.Type("two")
+	h.Keys(repltest.CTRL_W)
+	h.Type("three")
+	h.Keys(repltest.CTRL_W)
+	h.Type("x ")
+
+	h.Keys(repltest.CTRL_Y)
+	assertRows(t, h, "> x three")
+
+	h.Keys(ALT_Y)
+	assertRows(t, h, "> x two")
+	assertCursor(t, h, 7, 0)
+
+	h.Keys(ALT_Y)
+	assertRows(t, h, "> x one")
+
+	// wraps around to the most recent kill
+	h.Keys(ALT_Y)
+	assertRows(t, h, "> x three")
+
+	// only directly after a yank
+	h.Keys(repltest.LEFT, ALT_Y)
+	assertRows(t, h, "> x three")
+}
+
+func TestKillRingSize(t *testing.T) {
+	defer func(size int) {
+		repl.KILL_RING_SIZE = size
+	}(repl.KILL_RING_SIZE)
+
+	repl.KILL_RING_SIZE = 2
+
+	h := start(&echoHandler{}, 30, 5)
+	defer quit(t, h)
+
+	for _, word := range []string{"a", "b", "c"} {
+		h.Type(word)
+		h.Keys(repltest.CTRL_W)
+	}
+
+	// the oldest kill was dropped
+	h.Keys(repltest.CTRL_Y)
+	assertRows(t, h, "> c")
+
+	h.Keys(ALT_Y)
+	assertRows(t, h, "> b")
+
+	h.Keys(ALT_Y)
+	assertRows(t, h, "> c")
+}
+
+func TestYankPopAfterSearch(t *testing.T) {
+	h := start(&echoHandler{}, 30, 5)
+
+	h.Type("hello world")
+	h.Keys(repltest.CTRL_W, repltest.CTRL_Y, repltest.CTRL_A, repltest.CTRL_K)
+
+	// CTRL_Y only ends the search, so there is no yanked text to replace
+	h.Keys(repltest.CTRL_R, repltest.CTRL_Y, ALT_Y)
+	assertRows(t, h, ">")
+
+	h.Type("ab")
+	h.Keys(repltest.CTRL_Y)
+	assertRows(t, h, "> abhello world")
+}
@@ -0,0 +1,99 @@
+package repl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// number of rows used by msg, when printed from the start of a row
+func calcMessageHeight(msg string, w int) int {
+	h := 0
+
+	for _, line := range strings.Split(msg, "\n") {
+		lw := displayWidth(stripEscapes(line))
+
+		if lw == 0 || w <= 0 {
+			h += 1
+		} else {
+			h += (lw + w - 1) / w
+		}
+	}
+
+	return h
+}
+
+// in raw mode a newline doesn't return the cursor to the start of the row
+func (r *Repl) writeRawLines(msg string) {
+	fmt.Fprint(r.term, strings.ReplaceAll(msg, "\n", "\n\r"))
+}
+
+// clear the prompt, buffer and status bar, write msg, and redraw the prompt, buffer and status bar below msg
+func (r *Repl) printAbove(msg string) {
+	msg = strings.TrimSuffix(msg, "\n")
+
+	if !r.running() {
+		fmt.Fprint(r.term, msg+"\n")
+		return
+	} else if r.evaluating {
+		// the prompt isn't visible during evaluation, the message is simply interleaved with the output of the handler
+		r.writeRawLines(msg + "\n")
+		return
+	} else if r.queried {
+		// the prompt row is only known once the terminal answers the cursor position query
+		r.pendingMsgs = append(r.pendingMsgs, msg)
+		return
+	}
+
+	if r.promptRow < 0 {
+		r.updatePromptRow(0)
+	}
+
+	// the lines above the last line of a multi-line prompt are moved below the message too
+	top := r.promptRow - r.promptHeaderHeight()
+	if top < 0 {
+		top = 0
+	}
+
+	moveCursorTo(r.term, 0, top)
+	clearScreenAfterCursor(r.term)
+
+	r.writeRawLines(msg + "\n")
+	r.printPromptHeader()
+
+	// the terminal scrolls if the message doesn't fit
+	r.updatePromptRow(top + calcMessageHeight(msg, r.getWidth()) + r.promptHeaderHeight())
+
+	if r.overflow() {
+		// the very large buffer is redrawn from the top of the screen, so push the message into the scrollback first
+		moveCursorTo(r.term, 0, r.getHeight()-1)
+		fmt.Fprint(r.term, strings.Repeat("\n", r.getHeight()))
+	}
+
+	r.force(r.buffer, r.bufferPos)
+	r.drawMenu()
+	r.drawPicker()
+	r.drawSuggestion()
+}
+
+// Print a message above the prompt. This method can be called from any goroutine while Loop is running (e.g. to report background events):
+// the prompt, the input buffer and the status bar are cleared, the message is written, and the prompt, buffer, cursor and status bar are redrawn below the message.
+//
+// A newline is appended to the message if it doesn't end with one.
+func (r *Repl) Printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	r.do(func() {
+		r.printAbove(msg)
+	})
+}
+
+// Implements io.Writer, so a Repl can be used as the output of e.g. a log.Logger. Every call is printed above the prompt, just like Printf.
+func (r *Repl) Write(p []byte) (int, error) {
+	msg := string(p)
+
+	r.do(func() {
+		r.printAbove(msg)
+	})
+
+	return len(p), nil
+}
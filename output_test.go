@@ -0,0 +1,39 @@
+package repl_test
+
+import (
+	"testing"
+
+	"github.com/openengineer/go-repl/repltest"
+)
+
+func TestPrintf(t *testing.T) {
+	h := start(&echoHandler{}, 20, 6)
+
+	h.Type("abc")
+	h.Repl.Printf("one\ntwo")
+	h.Wait()
+
+	// the buffer and the cursor move below the message
+	assertRows(t, h, "one", "two", "> abc")
+	assertCursor(t, h, 5, 2)
+	assertStatus(t, h, "All")
+}
+
+func TestPrintfWhileQueried(t *testing.T) {
+	h := start(&echoHandler{}, 20, 6)
+
+	h.Terminal.HoldCursorReports(true)
+
+	h.Type("abc")
+	h.Keys(repltest.ENTER)
+
+	// the row of the new prompt isn't known until the terminal answers
+	h.Repl.Printf("msg")
+	h.Wait()
+	assertRows(t, h, "> abc", "abc", ">", "")
+
+	h.Terminal.HoldCursorReports(false)
+	h.Wait()
+	assertRows(t, h, "> abc", "abc", "msg", ">")
+	assertCursor(t, h, 2, 3)
+}
@@ -0,0 +1,356 @@
+package repl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// Maximum number of rows used by the fuzzy history picker below the buffer, 0 uses the whole screen.
+	// The prompt is scrolled up as far as needed to make room for the rows, up to the top of the screen.
+	HISTORY_PICKER_ROWS = 0
+)
+
+// a history entry that matches the query of the picker
+type _PickerMatch struct {
+	entry     int   // index in the history
+	score     int   // higher is better
+	positions []int // byte offsets of the matched characters
+}
+
+// _HistoryPicker lists the history entries that fuzzy match a query below the prompt, the buffer shows the selected entry
+type _HistoryPicker struct {
+	query     []byte
+	matches   []_PickerMatch
+	selected  int
+	offset    int // first visible row
+	backup    []byte
+	backupPos int
+}
+
+// the characters of the query must appear in the entry in the same order, but not necessarily next to each other
+// consecutive characters and characters at the start of a word score higher, gaps score lower
+func fuzzyMatch(entry []byte, query []rune, caseSensitive bool) (int, []int, bool) {
+	if len(query) == 0 {
+		return 0, nil, true
+	}
+
+	runes := make([]rune, 0, len(entry))
+	offsets := make([]int, 0, len(entry))
+
+	for i := 0; i < len(entry); {
+		c, size := utf8.DecodeRune(entry[i:])
+		if !caseSensitive {
+			c = unicode.ToLower(c)
+		}
+
+		runes = append(runes, c)
+		offsets = append(offsets, i)
+
+		i += size
+	}
+
+	// the first complete match ends here
+	end := -1
+	for i, qi := 0, 0; i < len(runes); i++ {
+		if runes[i] == query[qi] {
+			qi++
+
+			if qi == len(query) {
+				end = i
+				break
+			}
+		}
+	}
+
+	if end < 0 {
+		return 0, nil, false
+	}
+
+	// shortest match that ends there
+	start := end
+	for i, qi := end, len(query)-1; i >= 0 && qi >= 0; i-- {
+		if runes[i] == query[qi] {
+			start = i
+			qi--
+		}
+	}
+
+	score := 0
+	positions := make([]int, 0, len(query))
+
+	prev := -2
+	for i, qi := start, 0; i <= end && qi < len(query); i++ {
+		if runes[i] != query[qi] {
+			continue
+		}
+
+		score += 16
+
+		if i == prev+1 {
+			score += 8
+		}
+
+		if i == 0 || !(unicode.IsLetter(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+			score += 8
+		}
+
+		positions = append(positions, offsets[i])
+
+		prev = i
+		qi++
+	}
+
+	score -= (end + 1 - start) - len(query)
+
+	return score, positions, true
+}
+
+// best matches first, more recent entries first if the scores are equal, duplicate entries are only listed once
+func fuzzyMatches(history [][]byte, query []byte) []_PickerMatch {
+	q := []rune(string(query))
+
+	// smart case: an uppercase character in the query makes the search case-sensitive
+	caseSensitive := false
+	for _, c := range q {
+		if unicode.IsUpper(c) {
+			caseSensitive = true
+			break
+		}
+	}
+
+	matches := make([]_PickerMatch, 0)
+	seen := make(map[string]bool)
+
+	for i := len(history) - 1; i >= 0; i-- {
+		entry := history[i]
+		if seen[string(entry)] {
+			continue
+		}
+
+		seen[string(entry)] = true
+
+		if score, positions, ok := fuzzyMatch(entry, q, caseSensitive); ok {
+			matches = append(matches, _PickerMatch{i, score, positions})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	return matches
+}
+
+func (r *Repl) pickerActive() bool {
+	return r.picker != nil
+}
+
+// the buffer is the initial query
+func (r *Repl) startHistoryPicker() {
+	r.picker = &_HistoryPicker{
+		query:     cleanInput(bytes.ReplaceAll(r.buffer, []byte{'\n'}, []byte{' '})),
+		matches:   nil,
+		selected:  0,
+		offset:    0,
+		backup:    copyBytes(r.buffer),
+		backupPos: r.bufferPos,
+	}
+
+	r.updatePicker()
+}
+
+// the matches are updated after every change of the query
+func (r *Repl) updatePicker() {
+	p := r.picker
+
+	p.matches = fuzzyMatches(r.history, p.query)
+	p.selected = 0
+	p.offset = 0
+
+	r.selectPickerMatch(0)
+}
+
+func (r *Repl) selectPickerMatch(i int) {
+	p := r.picker
+
+	if i >= len(p.matches) {
+		i = len(p.matches) - 1
+	}
+
+	if i < 0 {
+		i = 0
+	}
+
+	p.selected = i
+
+	if len(p.matches) > 0 {
+		entry := r.history[p.matches[i].entry]
+
+		r.force(entry, len(entry))
+	} else {
+		r.force(p.backup, p.backupPos)
+	}
+
+	r.drawPicker()
+}
+
+func (r *Repl) closePicker() {
+	if r.picker == nil {
+		return
+	}
+
+	r.picker = nil
+
+	moveCursorTo(r.term, 0, r.menuRow())
+	clearScreenAfterCursor(r.term)
+
+	r.clearStatus()
+	r.writeStatus()
+}
+
+func (r *Repl) pickerRows() int {
+	n := r.innerHeight() - r.calcHeight()
+	if r.overflow() {
+		n = r.innerHeight() - r.calcViewHeight()
+	}
+
+	if HISTORY_PICKER_ROWS > 0 && n > HISTORY_PICKER_ROWS {
+		n = HISTORY_PICKER_ROWS
+	}
+
+	return n
+}
+
+func (r *Repl) drawPicker() {
+	p := r.picker
+	if p == nil {
+		return
+	}
+
+	visible := r.pickerRows()
+	if visible <= 0 {
+		return
+	}
+
+	// keep the selected entry visible
+	if p.selected < p.offset {
+		p.offset = p.selected
+	} else if p.selected >= p.offset+visible {
+		p.offset = p.selected - visible + 1
+	}
+
+	r.clearStatus()
+
+	y0 := r.reserveMenuRows(visible)
+
+	for i := 0; i < visible; i++ {
+		moveCursorTo(r.term, 0, y0+i)
+		clearRow(r.term)
+
+		if p.offset+i < len(p.matches) {
+			r.writePickerRow(p.offset + i)
+		}
+	}
+
+	r.writeStatus()
+}
+
+// a single entry at the current cursor position, the matched characters are bold, and newlines are shown as spaces
+func (r *Repl) writePickerRow(i int) {
+	p := r.picker
+	m := p.matches[i]
+
+	text := strings.ReplaceAll(string(r.history[m.entry]), "\n", " ")
+	text = truncateToWidth(text, r.getWidth()-1)
+
+	style := ""
+	if i == p.selected {
+		// black text on a grey background, see highlight()
+		style = "48;5;247;30"
+	}
+
+	matched := make(map[int]bool)
+	for _, pos := range m.positions {
+		matched[pos] = true
+	}
+
+	forEachGrapheme([]byte(text), func(start, stop, _ int) bool {
+		s := style
+		if matched[start] {
+			s = strings.TrimPrefix(style+";1", ";")
+		}
+
+		if s == "" {
+			fmt.Fprint(r.term, text[start:stop])
+		} else {
+			setStyle(r.term, s)
+			fmt.Fprint(r.term, text[start:stop])
+			resetDecorations(r.term)
+		}
+
+		return true
+	})
+}
+
+// the query is shown in the status bar, like the filter of the reverse-search
+func (r *Repl) pickerStatus() string {
+	p := r.picker
+
+	n := len(p.matches)
+	if n == 0 {
+		return "0/0"
+	}
+
+	return fmt.Sprintf("%d/%d", p.selected+1, n)
+}
+
+// returns false if the keystroke closes the picker and must be handled as usual
+func (r *Repl) dispatchPicker(k Key) bool {
+	p := r.picker
+
+	switch {
+	case k.is(KEY_UP, 0), k.isCtrl('p'), k.is(KEY_TAB, MOD_SHIFT):
+		r.selectPickerMatch(p.selected - 1)
+	case k.is(KEY_DOWN, 0), k.isCtrl('n'), k.is(KEY_TAB, 0):
+		r.selectPickerMatch(p.selected + 1)
+	case k.is(KEY_PAGE_UP, 0):
+		r.selectPickerMatch(p.selected - r.pickerRows())
+	case k.is(KEY_PAGE_DOWN, 0):
+		r.selectPickerMatch(p.selected + r.pickerRows())
+	case k.is(KEY_ENTER, 0): // RETURN keeps the selected entry in the buffer
+		r.closePicker()
+
+		r.historyIdx = -1
+		r.backup = nil
+	case k.is(KEY_ESCAPE, 0), k.isCtrl('c'), k.isCtrl('g'): // ESC, CTRL-C and CTRL-G restore the buffer
+		backup, backupPos := p.backup, p.backupPos
+
+		r.closePicker()
+		r.force(backup, backupPos)
+	case k.is(KEY_BACKSPACE, 0), k.isCtrl('h'):
+		if len(p.query) > 0 {
+			p.query = p.query[0:prevGraphemePos(p.query, len(p.query))]
+			r.updatePicker()
+		}
+	case k.isCtrl('u'):
+		p.query = p.query[:0]
+		r.updatePicker()
+	case k.isText():
+		p.query = append(p.query, cleanInput([]byte(string(k.Rune)))...)
+		r.updatePicker()
+	case k.Code == keyPaste:
+		p.query = append(p.query, cleanInput([]byte(strings.ReplaceAll(k.text, "\n", " ")))...)
+		r.updatePicker()
+	default:
+		r.closePicker()
+
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,108 @@
+package repl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		entry     string
+		query     string
+		positions []int
+		ok        bool
+	}{
+		{"abc", "", nil, true},
+		{"abc", "abc", []int{0, 1, 2}, true},
+		{"axbxc", "abc", []int{0, 2, 4}, true},
+		{"abc", "acb", nil, false},
+		{"ab", "abc", nil, false},
+		// the shortest match ending at the first complete match
+		{"a a b", "ab", []int{2, 4}, true},
+		// byte offsets of multi-byte characters
+		{"éa世b", "世b", []int{3, 6}, true},
+		{"ABC", "abc", []int{0, 1, 2}, true},
+	}
+
+	for _, test := range tests {
+		_, positions, ok := fuzzyMatch([]byte(test.entry), []rune(test.query), false)
+
+		if ok != test.ok || !reflect.DeepEqual(positions, test.positions) {
+			t.Errorf("%q in %q: expected %v %v, got %v %v", test.query, test.entry, test.positions, test.ok, positions, ok)
+		}
+	}
+
+	if _, _, ok := fuzzyMatch([]byte("ABC"), []rune("abc"), true); ok {
+		t.Errorf("expected no case-sensitive match")
+	}
+}
+
+func TestFuzzyMatchScore(t *testing.T) {
+	score := func(entry, query string) int {
+		s, _, _ := fuzzyMatch([]byte(entry), []rune(query), false)
+		return s
+	}
+
+	better := []struct {
+		entry, worse, query string
+	}{
+		// consecutive characters
+		{"xabc", "xaxbc", "abc"},
+		// characters at the start of a word
+		{"x bc", "xabc", "bc"},
+		{"x-bc", "xabc", "bc"},
+		// smaller gaps
+		{"axxb", "axxxb", "ab"},
+	}
+
+	for _, test := range better {
+		if a, b := score(test.entry, test.query), score(test.worse, test.query); a <= b {
+			t.Errorf("%q: expected %q (%d) to score higher than %q (%d)", test.query, test.entry, a, test.worse, b)
+		}
+	}
+
+	if s := score("abc", "abc"); s != 3*16+2*8+8 {
+		t.Errorf("expected a score of %d, got %d", 3*16+2*8+8, s)
+	}
+}
+
+func TestFuzzyMatches(t *testing.T) {
+	history := [][]byte{
+		[]byte("git commit"),
+		[]byte("go test"),
+		[]byte("gt"),
+		[]byte("git commit"),
+		[]byte("go vet"),
+		[]byte("Go doc"),
+	}
+
+	entries := func(query string) []int {
+		res := make([]int, 0)
+		for _, m := range fuzzyMatches(history, []byte(query)) {
+			res = append(res, m.entry)
+		}
+
+		return res
+	}
+
+	tests := []struct {
+		query   string
+		entries []int
+	}{
+		// all the entries, most recent first, the duplicate is listed once
+		{"", []int{5, 4, 3, 2, 1}},
+		// the consecutive match ranks first, then the match at the start of a word
+		{"gt", []int{2, 1, 3, 4}},
+		// equal scores are ordered by recency
+		{"go", []int{5, 4, 1, 3}},
+		// smart case
+		{"Go", []int{5}},
+		{"xyz", []int{}},
+	}
+
+	for _, test := range tests {
+		if got := entries(test.query); !reflect.DeepEqual(got, test.entries) {
+			t.Errorf("%q: expected entries %v, got %v", test.query, test.entries, got)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package repl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// When the input isn't a terminal (e.g. `mytool < commands.txt`), the input is read line by line and evaluated without prompt, status bar or escape sequences.
+// History isn't recorded in this mode.
+func (r *Repl) plainLoop() error {
+	r.lineReader = bufio.NewReader(r.term)
+
+	for !r.quitRequested() {
+		line, err := r.readPlainStatement()
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return &InputError{err}
+		}
+
+		out := r.plainEval(strings.TrimSpace(line))
+
+		if len(out) > 0 && !r.quitRequested() {
+			fmt.Fprint(r.term, out+"\n")
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return ErrQuit
+}
+
+// returns io.EOF with the last line if it isn't terminated by a newline
+func (r *Repl) readPlainLine() (string, error) {
+	line, err := r.lineReader.ReadString('\n')
+
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+
+	return line, err
+}
+
+// lines are joined until the Validator considers them complete
+func (r *Repl) readPlainStatement() (string, error) {
+	line, err := r.readPlainLine()
+
+	v, ok := r.handler.(Validator)
+	if !ok {
+		return line, err
+	}
+
+	for err == nil && !v.IsComplete(line) {
+		var next string
+		next, err = r.readPlainLine()
+
+		if err == nil || next != "" {
+			line += "\n" + next
+		}
+	}
+
+	return line, err
+}
+
+func (r *Repl) plainEval(buffer string) string {
+	if h, ok := r.handler.(ContextHandler); ok {
+		return h.EvalContext(context.Background(), buffer)
+	} else {
+		return r.handler.Eval(buffer)
+	}
+}
@@ -2,75 +2,160 @@
 package repl
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"io"
 
 	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"golang.org/x/term"
 )
 
 var (
-	// Period between polls for terminal size changes.
+	// Period between polls for terminal size changes, only used if the terminal doesn't signal size changes (see ResizeNotifier).
 	// 10ms is the default, human reaction times are an order of magnitude slower than this interval,
 	// and auto generated escape sequence bytes are an order of magnitude faster than this interval.
 	SIZE_POLLING_INTERVAL = 10 * time.Millisecond
 
+	// Keystrokes following an evaluation are queued until the terminal reports the new prompt position, or until this timeout expires.
+	CURSOR_QUERY_TIMEOUT = 500 * time.Millisecond
+
 	// Used by the package maintainer:
 	DEBUG = "" // a non-empty string specifies the destination file for debugging info
+
+	// Returned by Loop when the REPL is quit, either with CTRL-D or by calling Quit.
+	ErrQuit = errors.New("quit")
 )
 
+// All exported methods can be called from any goroutine, except from the synchronous Handler callbacks (Prompt, ContinuationPrompt, Tab, Complete, FilterPaste, IsComplete, Highlight and Hint).
 type Repl struct {
 	handler Handler
+	term    Terminal
 
 	history     [][]byte // simply keep everything, it doesn't matter
 	historyDir  string   // directory where to store history files
+	historyPath string   // empty if history isn't persisted
 	historyIdx  int      // -1 for last
 	historyFile *os.File // open history file, so we can keep appending
+	unsaved     [][]byte // history entries evaluated while no history file was open
 
 	phraseRe *regexp.Regexp
 
-	reader *_StdinReader
-
-	buffer    []byte // input bytes are accumulated
-	backup    []byte // we can go into a history line, and start editing it
-	prevDel   []byte // previous deletion
-	filter    []byte // for reverse search
-	bufferPos int    // position in the buffer (0-based)
-	viewStart int    // usually 0, but can be positive in case of very large inputs
-	viewEnd   int    //
-	promptRow int    // 0-based
-	width     int
-	height    int
+	sizeChanges <-chan struct{} // handled by Loop, just like keystrokes
+
+	reader      *_StdinReader
+	parser      *_KeyParser
+	lineReader  *bufio.Reader // only used if the input isn't a terminal
+	pending     []Key         // keystrokes received during an evaluation, or while waiting for the answer to a cursor position query
+	pendingMsgs []string      // messages printed while waiting for the answer to a cursor position query
+	queried     bool          // waiting for the answer to a cursor position query
+	queriedAt   time.Time
+	evaluating  bool // the handler is evaluating the buffer, the prompt isn't visible
+
+	buffer     []byte // input bytes are accumulated
+	backup     []byte // we can go into a history line, and start editing it
+	filter     []byte // for reverse search
+	menu       *_CompletionMenu
+	picker     *_HistoryPicker
+	tabbed     bool // previous keystroke was a TAB that left several candidates
+	bindings   map[string]Action
+	keyPrefix  []Key     // start of a bound key sequence
+	vi         *_ViState // nil unless the vi editing mode is enabled
+	undoStack  []_UndoEntry
+	redoStack  []_UndoEntry
+	killRing   [][]byte // deletions, most recent last
+	yankIdx    int      // kill ring entry inserted by the last yank
+	yankStart  int      // span of the buffer inserted by the last yank
+	yankEnd    int
+	goalCol    int    // display column kept by consecutive Up/Down movements
+	action     string // name of the action handling the current keystroke, empty for other keystrokes
+	prevAction string
+	undoGroup  string // group of the last undoable edit, see undoable()
+	spans      []Span // styles of the buffer as it was last drawn, nil without Highlighter
+	suggested  bool   // a suggestion is drawn after the buffer
+	bufferPos  int    // position in the buffer (0-based)
+	viewStart  int    // usually 0, but can be positive in case of very large inputs
+	viewEnd    int    //
+	promptRow  int    // 0-based
+	width      int
+	height     int
+
+	state    int32         // _NOT_STARTED, _RUNNING or _STOPPED, accessed atomically
+	events   chan func()   // applied by Loop
+	stopped  chan struct{} // closed when Loop returns
+	quitting chan struct{} // closed when the REPL is asked to quit
+	quitOnce *sync.Once
+	err      error // reason for quitting, nil if requested by the user
 
 	onEnd func()
 	debug *os.File
 }
 
-// Create a new Repl using your custom Handler.
+// Create a new Repl using your custom Handler. The Repl runs in the terminal connected to stdin and stdout.
 func NewRepl(handler Handler) *Repl {
+	return NewTerminalRepl(handler, NewStdTerminal())
+}
 
+// Create a new Repl using your custom Handler, that runs in a custom Terminal.
+func NewTerminalRepl(handler Handler, t Terminal) *Repl {
 	r := &Repl{
 		handler:     handler,
+		term:        t,
 		historyDir:  "",
+		historyPath: "",
 		history:     make([][]byte, 0),
 		historyIdx:  -1,
 		historyFile: nil,
-		phraseRe:    regexp.MustCompile(`([0-9a-zA-Z_\-\.]+)`),
-		reader:      newStdinReader(),
+		unsaved:     make([][]byte, 0),
+		sizeChanges: nil,
+		phraseRe:    regexp.MustCompile(`([\p{L}\p{N}\p{M}_\-\.]+)`),
+		reader:      newStdinReader(t),
+		parser:      newKeyParser(),
+		lineReader:  nil,
+		pending:     make([]Key, 0),
+		pendingMsgs: make([]string, 0),
+		queried:     false,
+		queriedAt:   time.Time{},
+		evaluating:  false,
 		buffer:      nil,
 		backup:      nil,
-		prevDel:     nil,
 		filter:      nil,
+		menu:        nil,
+		picker:      nil,
+		tabbed:      false,
+		bindings:    newBindings(),
+		keyPrefix:   make([]Key, 0),
+		vi:          nil,
+		undoStack:   make([]_UndoEntry, 0),
+		redoStack:   make([]_UndoEntry, 0),
+		killRing:    make([][]byte, 0),
+		yankIdx:     0,
+		yankStart:   0,
+		yankEnd:     0,
+		goalCol:     0,
+		action:      "",
+		prevAction:  "",
+		undoGroup:   "",
+		spans:       nil,
+		suggested:   false,
 		bufferPos:   0,
 		viewStart:   0,
 		viewEnd:     -1,
 		promptRow:   -1,
 		width:       0,
 		height:      0,
+		state:       _NOT_STARTED,
+		events:      make(chan func()),
+		stopped:     make(chan struct{}),
+		quitting:    make(chan struct{}),
+		quitOnce:    &sync.Once{},
+		err:         nil,
 		onEnd:       nil,
 		debug:       nil,
 	}
@@ -112,34 +197,92 @@ func (r *Repl) log(format string, args ...interface{}) {
 	}
 }
 
-func (r *Repl) notifySizeChange() {
-	getSize := func() (int, int) {
-		w, h, err := term.GetSize(0)
-		if err != nil {
-			panic(err)
-		}
+// a detached terminal can report a zero size, which can't be drawn on
+func (r *Repl) getTermSize() (int, int, error) {
+	w, h, err := r.term.GetSize()
+	if err != nil {
+		return 0, 0, &SizeError{err}
+	} else if w < 1 || h < 1 {
+		return 0, 0, &SizeError{fmt.Errorf("invalid size %dx%d", w, h)}
+	}
 
-		return w, h
+	return w, h, nil
+}
+
+func (r *Repl) notifySizeChange() error {
+	w, h, err := r.getTermSize()
+	if err != nil {
+		return err
 	}
 
-	r.width, r.height = getSize()
+	r.width, r.height = w, h
+
+	if rn, ok := r.term.(ResizeNotifier); ok {
+		r.sizeChanges = rn.SizeChanges()
+	}
+
+	if r.sizeChanges == nil {
+		r.pollSize(w, h)
+	}
+
+	return nil
+}
+
+// fallback for terminals that don't signal size changes
+func (r *Repl) pollSize(w, h int) {
+	sizeChanges := make(chan struct{}, 1)
+
+	r.sizeChanges = sizeChanges
 
 	go func() {
 		for {
-			<-time.After(SIZE_POLLING_INTERVAL)
+			select {
+			case <-r.quitting:
+				return
+			case <-time.After(SIZE_POLLING_INTERVAL):
+			}
+
+			newW, newH, err := r.term.GetSize()
+			if err == nil && newW == w && newH == h {
+				continue
+			}
 
-			newW, newH := getSize()
+			w, h = newW, newH
 
-			r.resize(newW, newH)
+			select {
+			case sizeChanges <- struct{}{}:
+			default:
+			}
 		}
 	}()
 }
 
+// the terminal stops signalling size changes once Loop returns, the polling goroutine stops by itself
+func (r *Repl) stopSizeChanges() {
+	if s, ok := r.term.(_SizeChangesStopper); ok {
+		s.stopSizeChanges()
+	}
+}
+
+func (r *Repl) handleSizeChange() {
+	w, h, err := r.getTermSize()
+	if err != nil {
+		r.fail(err)
+		return
+	}
+
+	r.resize(w, h)
+}
+
 func (r *Repl) resize(w, h int) {
 	if w != r.width || h != r.height {
 		r.width, r.height = w, h
 
 		r.force(r.buffer, r.bufferPos)
+
+		r.drawMenu()
+		r.drawPicker()
+		r.drawSuggestion()
 	}
 }
 
@@ -154,221 +297,238 @@ func (r *Repl) stopSearch() {
 	r.writeStatus()
 }
 
-// turn stdin bytes into something useful
-func (r *Repl) dispatch(b []byte) {
-	n := len(b)
+// printable input goes into the search filter if reverse-search is active, or into the buffer otherwise
+func (r *Repl) addTextToActiveBuffer(b []byte) {
+	text := cleanInput(b)
+	if len(text) == 0 {
+		return
+	}
 
-	r.log("keypress: %v\n", b)
+	if r.searchActive() {
+		r.filter = append(r.filter, text...)
 
-	if n == 1 {
-		switch b[0] {
-		case 0: // NULL, or CTRL-2
-			return
-		case 1: // CTRL-A
-			r.moveToBufferStart()
-		case 2: // CTRL-B
-			r.moveLeftOneChar()
-		case 3: // CTRL-C
-			if r.searchActive() {
-				r.stopSearch()
-			}
+		r.updateSearchResult()
+	} else {
+		r.clearStatus()
+		r.addBytesToBuffer(text)
+	}
 
-			r.clearBuffer()
-			r.writeStatus()
-		case 4: // CTRL-D
-			r.quit()
-		case 5: // CTRL-E
-			r.moveToBufferEnd()
-		case 6: // CTRL-F
-			r.moveRightOneChar()
-		case 8: // CTRL-H
-			r.backspaceActiveBuffer()
-		case 9: // TAB
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.tab()
-			}
-		case 10: // SHIFT-ENTER
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.clearStatus()
-				r.addBytesToBuffer([]byte{'\n'})
-				r.writeStatus()
-			}
-		case 11: // CTRL-K
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.clearToEnd()
-			}
-		case 12: // CTRL-L
-			r.redrawScreen()
-		case 13: // RETURN
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.evalBuffer()
-			}
-		case 14: // CTRL-N
-			r.historyForward()
-		case 16: // CTRL-P
-			r.historyBack()
-		case 17: // CTRL-Q
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.clearOnePhraseRight()
-			}
-		case 18: // CTRL-R
-			if !r.searchActive() {
-				r.startReverseSearch()
-			}
-		case 21: // CTRL-U
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.clearToStart()
-			}
-		case 22: // CTRL-V
-			return
-		case 25: // CTRL-Y
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.clearStatus()
-				r.insertPrevDel()
-				r.writeStatus()
-			}
-		case 23: // CTRL-W
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.clearOnePhraseLeft()
-			}
-		case 27: // ESC
-			if r.searchActive() {
-				r.stopSearch()
-			} else {
-				r.clearBuffer()
-				r.writeStatus()
-			}
-		case 127: // BACKSPACE
-			r.backspaceActiveBuffer()
-		default:
-			if b[0] >= 32 {
-				if r.searchActive() {
-					r.filter = append(r.filter, b[0])
-
-					r.updateSearchResult()
-				} else {
-					r.clearStatus()
-					r.addBytesToBuffer([]byte{b[0]})
-				}
-				r.writeStatus()
+	r.writeStatus()
+}
+
+// dispatch the decoded keystrokes, consecutive printable characters are inserted as a single edit
+func (r *Repl) dispatchKeys(keys []Key) {
+	for i := 0; i < len(keys); i++ {
+		k := keys[i]
+
+		if r.queried && k.Code != keyCursorPos {
+			// the prompt position must be known before the keystrokes following an evaluation can be handled
+			r.pending = append(r.pending, k)
+			continue
+		}
+
+		if r.isUnboundText(k) && !r.menuActive() && !r.pickerActive() {
+			text := make([]byte, 0)
+
+			for ; i < len(keys) && r.isUnboundText(keys[i]); i++ {
+				text = append(text, string(keys[i].Rune)...)
 			}
+
+			i--
+
+			r.tabbed = false
+			r.prevAction, r.action = r.action, ""
+			r.undoable("insert", func() {
+				r.addTextToActiveBuffer(text)
+			})
+			continue
 		}
-	} else if n == 2 && b[0] == 195 {
-		// ALT + KEY
-	} else if n > 2 && b[0] == 27 && b[1] == 79 { // [ESCAPE, O, ...]
-		switch b[2] {
-		case 80: // F1
-		case 81: // F2
-		// ...
-		default:
-			// function keys not yet supported
+
+		r.dispatch(k)
+	}
+
+	r.drawSuggestion()
+}
+
+// turn a keystroke into something useful
+func (r *Repl) dispatch(k Key) {
+	r.log("keypress: %v\n", k)
+
+	if k.Code == keyCursorPos {
+		if r.queried || k.row > 0 {
+			r.handleCursorQuery(k.col, k.row)
+			return
 		}
-	} else if n > 2 && b[0] == 27 && b[1] == 91 { // [ESCAPE, OPEN_BRACKET, ...]
-		if n == 3 {
-			switch b[2] {
-			case 65:
-				r.historyBack()
-			case 66:
-				r.historyForward()
-			case 67: // ArrowRight
-				r.moveRightOneChar()
-			case 68: // ArrowLeft
-				r.moveLeftOneChar()
-			case 72:
-				r.moveToBufferStart()
-			case 70:
-				r.moveToBufferEnd()
-			}
-		} else if n == 4 {
-			if b[2] == 51 && b[3] == 126 {
-				r.deleteChar()
-			}
-		} else if n == 6 && b[2] == 49 && b[3] == 59 {
-			if b[4] == 53 && b[5] == 68 { // CTRL-ArrowLeft
-				r.moveLeftOnePhrase()
-			} else if b[4] == 53 && b[5] == 67 {
-				r.moveRightOnePhrase()
-			} else if b[4] == 53 && b[5] == 66 {
-				//r.moveDownOneLine()
-			} else if b[4] == 53 && b[5] == 65 {
-				//r.moveUpOneLine()
-			}
-		} else if len(b) > 5 && b[n-1] == 82 {
-			parts := strings.Split(string(b[2:n-1]), ";")
-			row, err := strconv.Atoi(parts[0])
-			if err == nil {
-				col, err := strconv.Atoi(parts[1])
-				if err == nil {
-					r.handleCursorQuery(col-1, row-1)
-				}
-			}
+
+		// CTRL/ALT/SHIFT-F3 is indistinguishable from a cursor position report on the first row, but no report was requested
+		k = Key{Code: KEY_F3, Mod: k.Mod}
+	}
+
+	r.prevAction, r.action = r.action, ""
+
+	if r.menuActive() {
+		handled := false
+
+		// cycling through the candidates is undone at once
+		r.undoable("menu", func() {
+			handled = r.dispatchMenu(k)
+		})
+
+		if handled {
+			return
 		}
-	} else if len(b) > 6 && b[n-1] == 82 {
-		// go backwards until the esc char
-		for i := n - 2; i >= 0; i-- {
-			if b[i] == 27 && b[i+1] == 91 {
-				parts := strings.Split(string(b[i+2:n-1]), ";")
-				row, err := strconv.Atoi(parts[0])
-				if err == nil {
-					col, err := strconv.Atoi(parts[1])
-					if err == nil {
-						r.handleCursorQuery(col-1, row-1)
-					}
-				}
+	}
 
-				printable := make([]byte, 0)
-				for _, b_ := range b[0:i] {
-					if b_ >= 32 {
-						printable = append(printable, b_)
-					}
-				}
+	if r.pickerActive() {
+		handled := false
 
-				if len(printable) > 0 {
-					r.clearStatus()
-					r.addBytesToBuffer(printable)
-					r.writeStatus()
-				}
+		// browsing the matches is undone at once
+		r.undoable("picker", func() {
+			handled = r.dispatchPicker(k)
+		})
 
-				break
-			}
+		if handled {
+			return
 		}
-	} else {
-		//r.cleanAndAddToBuffer(b)
 	}
 
-	return
+	if k.Code == keyPaste {
+		r.tabbed = false
+		r.keyPrefix = r.keyPrefix[:0]
+		r.undoable("", func() {
+			r.paste(k.text)
+		})
+		return
+	}
+
+	if r.vi != nil && len(r.keyPrefix) == 0 && r.dispatchVi(k) {
+		return
+	}
+
+	r.dispatchBinding(k)
+}
+
+// pasted newlines are inserted like SHIFT-ENTER, instead of evaluating the buffer
+func (r *Repl) paste(text string) {
+	// terminals send a carriage return for every newline
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	if f, ok := r.handler.(PasteFilter); ok {
+		text = f.FilterPaste(text)
+	}
+
+	if r.searchActive() {
+		// the search filter is a single line
+		r.addTextToActiveBuffer([]byte(strings.ReplaceAll(text, "\n", " ")))
+		return
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = string(cleanInput([]byte(line)))
+	}
+
+	b := []byte(strings.Join(lines, "\n"))
+	if len(b) == 0 {
+		return
+	}
+
+	r.clearStatus()
+	r.addBytesToBuffer(b)
+	r.writeStatus()
 }
 
 func (r *Repl) handleCursorQuery(x, y int) {
 	r.updatePromptRow(y)
 
 	r.writeStatus()
+
+	r.queried = false
+
+	// now that the prompt position is known, the messages and keystrokes received in the meantime can be processed
+	// (those following a new evaluation are queued again)
+	r.printPending()
+
+	pending := r.pending
+	r.pending = make([]Key, 0)
+
+	r.dispatchKeys(pending)
+}
+
+// ask the terminal for the position of the prompt, keystrokes are queued until the answer arrives
+func (r *Repl) queryPromptRow() {
+	r.queried = true
+	r.queriedAt = time.Now()
+
+	queryCursorPos(r.term)
+}
+
+// some terminals never answer, don't queue the keystrokes forever
+func (r *Repl) queryTimedOut() {
+	if !r.queried {
+		return
+	}
+
+	r.log("cursor position query timed out\n")
+
+	r.queried = false
+
+	r.printPending()
+
+	pending := r.pending
+	r.pending = make([]Key, 0)
+
+	r.dispatchKeys(pending)
 }
 
+func (r *Repl) printPending() {
+	msgs := r.pendingMsgs
+	r.pendingMsgs = make([]string, 0)
+
+	for _, msg := range msgs {
+		r.printAbove(msg)
+	}
+}
+
+// the lines of a multi-line prompt above the last line, and the last line that is followed by the buffer
+func (r *Repl) splitPrompt() (string, string) {
+	prompt := r.handler.Prompt()
+
+	i := strings.LastIndexByte(prompt, '\n')
+
+	return prompt[0 : i+1], prompt[i+1:]
+}
+
+// the buffer is redrawn after the last line of the prompt, the lines above it are only printed by printPromptHeader
 func (r *Repl) printPrompt() {
-	moveToRowStart()
-	fmt.Print(r.handler.Prompt())
+	_, last := r.splitPrompt()
+
+	moveToRowStart(r.term)
+	fmt.Fprint(r.term, last)
+}
+
+func (r *Repl) printPromptHeader() {
+	header, _ := r.splitPrompt()
+
+	moveToRowStart(r.term)
+	r.writeRawLines(header)
+}
+
+// number of rows used by the lines above the last line of the prompt
+func (r *Repl) promptHeaderHeight() int {
+	header, _ := r.splitPrompt()
+	if header == "" {
+		return 0
+	}
+
+	return calcMessageHeight(strings.TrimSuffix(header, "\n"), r.getWidth())
 }
 
 func (r *Repl) resetBuffer() {
 	r.bufferPos = 0
 	r.buffer = make([]byte, 0)
+	r.spans = nil
 	r.printPrompt()
 	r.viewStart = 0
 	r.viewEnd = -1
@@ -396,29 +556,56 @@ func (r *Repl) boundPromptRow() {
 	xe, ye := r.cursorCoord(n)
 
 	if ye >= r.innerHeight() {
-		moveCursorTo(xe, ye)
-		fmt.Print("\n")
+		moveCursorTo(r.term, xe, ye)
+		fmt.Fprint(r.term, "\n")
 		r.updatePromptRow(r.promptRow - (ye + 1 - r.innerHeight()))
 	}
 }
 
 func (r *Repl) addBytesToBuffer(bs []byte) {
 	if r.bufferPos == r.bufferLen() {
-		xBef, _ := r.cursorCoord(-1)
+		x, _ := r.cursorCoord(-1)
 
 		r.bufferPos += len(bs)
 		len_ := r.bufferLen()
 		r.buffer = append(r.buffer, bs...)
 
-		if !r.overflow() {
-			needSync := false
-			for _, b := range bs {
-				r.writeByte(b)
+		// a combining character could change the width of the last cluster of the previous buffer, in which case everything is redrawn
+		if isGraphemeBoundary(r.buffer, len_) && !r.overflow() {
+			w := r.getWidth()
+
+			// the new text can change the style of the preceding text (e.g. a keyword or a closing quote), which is then rewritten as well
+			spans := r.highlightBuffer()
+
+			from := firstStyleChange(r.spans, spans, len_)
+			if from < len_ {
+				x, _ = r.cursorCoord(from)
+				r.syncCursorTo(from)
+			}
 
-				if b != '\n' && xBef == r.getWidth()-1 {
+			r.spans = spans
+
+			r.writeBuffer(from, r.bufferLen())
+
+			needSync := false
+			forEachGrapheme(r.buffer[from:], func(start, stop, cw int) bool {
+				if r.buffer[from+start] == '\n' {
+					x = r.continuationLen()
+				} else if x+cw >= w {
+					// the terminal cursor position lags behind when the last column is reached (or skipped by a wide character)
 					needSync = true
+
+					if x+cw > w {
+						x = cw
+					} else {
+						x = 0
+					}
+				} else {
+					x += cw
 				}
-			}
+
+				return true
+			})
 
 			if needSync {
 				r.syncCursor()
@@ -446,44 +633,75 @@ func (r *Repl) addBytesToBuffer(bs []byte) {
 	r.force(newBuffer, newPos) // force should take into account extra long lines
 }
 
+// prompt width in columns, escape sequences (e.g. colors) don't count
 func (r *Repl) promptLen() int {
-	return len(r.handler.Prompt())
+	_, last := r.splitPrompt()
+
+	return displayWidth(stripEscapes(last))
+}
+
+// printed after every newline in the buffer
+func (r *Repl) continuationPrompt() string {
+	if p, ok := r.handler.(ContinuationPrompter); ok {
+		return p.ContinuationPrompt()
+	}
+
+	return ""
+}
+
+func (r *Repl) continuationLen() int {
+	return displayWidth(stripEscapes(r.continuationPrompt()))
 }
 
 func (r *Repl) bufferLen() int {
 	return len(r.buffer)
 }
 
-func relCursorCoord(buffer []byte, x0 int, bufferPos int, w int) (int, int) {
+// x0 is the width of the prompt, x1 is the width of the continuation prompt
+func relCursorCoord(buffer []byte, x0 int, x1 int, bufferPos int, w int) (int, int) {
 	x := x0
 	y := 0
 
-	for j, c := range buffer {
-		if j >= bufferPos {
-			break
-		} else if c == '\n' {
-			x = 0
+	forEachGrapheme(buffer, func(start, stop, cw int) bool {
+		if start >= bufferPos {
+			// the cursor is on the wide character, which might have been moved to the next row
+			if buffer[start] != '\n' && x+cw > w {
+				x = 0
+				y += 1
+			}
+
+			return false
+		} else if buffer[start] == '\n' {
+			x = x1
 			y += 1
 		} else {
-			x += 1
+			// wide characters don't fit in the last column, and are moved to the next row
+			if x+cw > w {
+				x = 0
+				y += 1
+			}
+
+			x += cw
 		}
 
-		if x == w {
+		if x >= w {
 			x = 0
 			y += 1
 		}
-	}
+
+		return true
+	})
 
 	return x, y
 }
 
-func calcHeight(buffer []byte, x0 int, w int) int {
-	_, y := relCursorCoord(buffer, x0, len(buffer), w)
+func calcHeight(buffer []byte, x0 int, x1 int, w int) int {
+	_, y := relCursorCoord(buffer, x0, x1, len(buffer), w)
 	return y + 1
 }
 
 func (r *Repl) calcHeight() int {
-	return calcHeight(r.buffer, r.promptLen(), r.getWidth())
+	return calcHeight(r.buffer, r.promptLen(), r.continuationLen(), r.getWidth())
 }
 
 func (r *Repl) calcViewHeight() int {
@@ -491,15 +709,7 @@ func (r *Repl) calcViewHeight() int {
 		r.viewEnd = r.bufferLen()
 	}
 
-	return calcHeight(r.buffer[r.viewStart:r.viewEnd], r.promptLen(), r.getWidth())
-}
-
-func (r *Repl) calcViewStartHeight() int {
-	return calcHeight(r.buffer[0:r.viewStart], r.promptLen(), r.getWidth())
-}
-
-func (r *Repl) calcViewEndHeight() int {
-	return r.calcHeight() - r.calcViewHeight()
+	return calcHeight(r.buffer[r.viewStart:r.viewEnd], r.promptLen(), r.continuationLen(), r.getWidth())
 }
 
 // i is 0-based index in current buffer
@@ -510,50 +720,15 @@ func (r *Repl) cursorCoord(bufferPos int) (int, int) {
 		bufferPos = r.bufferPos
 	}
 
-	x, y := relCursorCoord(r.buffer[r.viewStart:], r.promptLen(), bufferPos-r.viewStart, w)
+	x, y := relCursorCoord(r.buffer[r.viewStart:], r.promptLen(), r.continuationLen(), bufferPos-r.viewStart, w)
 
 	y += r.promptRow
 
 	return x, y
 }
 
-// return bufferPos that matches (x,y) as best as possible
-func (r *Repl) calcBufferPos(x, y int) int {
-	xc := r.promptLen()
-	yc := r.promptRow
-
-	for i, c := range r.buffer[r.viewStart:] {
-		if yc > y {
-			r.log("overshoot\n")
-			return i - 1 + r.viewStart
-		} else if yc == y && xc >= x {
-			r.log("calc pos for %d,%d -> %d (%d,%d)\n", x, y, i+r.viewStart, xc, yc)
-			return i + r.viewStart
-		}
-
-		if c == '\n' {
-			xc = 0
-			yc += 1
-		} else {
-			xc += 1
-		}
-
-		if xc == r.getWidth() {
-			xc = 0
-			yc += 1
-		}
-
-	}
-
-	if r.viewEnd >= 0 {
-		return r.viewEnd
-	} else {
-		return r.bufferLen()
-	}
-}
-
 func (r *Repl) clearAfterPrompt() {
-	moveCursorTo(0, r.getHeight()-1)
+	moveCursorTo(r.term, 0, r.getHeight()-1)
 
 	if r.promptRow < 0 {
 		r.updatePromptRow(0)
@@ -561,12 +736,12 @@ func (r *Repl) clearAfterPrompt() {
 
 	dy := (r.getHeight() - 1 - r.promptRow)
 
-	clearRows(dy)
+	clearRows(r.term, dy)
 }
 
 // clear as much as possible
 func (r *Repl) clearBuffer() {
-	moveCursorTo(0, r.getHeight()-1)
+	moveCursorTo(r.term, 0, r.getHeight()-1)
 
 	r.log("clearing buffer\n")
 	if r.promptRow < 0 {
@@ -575,8 +750,8 @@ func (r *Repl) clearBuffer() {
 
 	dy := (r.getHeight() - 1 - r.promptRow)
 
-	clearRows(dy)
-	clearRow()
+	clearRows(r.term, dy)
+	clearRow(r.term)
 
 	r.resetBuffer()
 }
@@ -592,31 +767,39 @@ func copyBytes(b []byte) []byte {
 }
 
 func (r *Repl) adjustBufferView() {
+	r.viewStart = snapGraphemePos(r.buffer, r.viewStart)
+	r.viewEnd = snapGraphemePos(r.buffer, r.viewEnd)
+
 	if r.bufferPos < r.viewStart {
 		r.viewStart = r.bufferPos
 		r.viewEnd = r.bufferLen()
 
-		for r.viewOverflow() {
-			r.viewEnd -= 1
+		for r.viewOverflow() && r.viewEnd > r.viewStart {
+			r.viewEnd = prevGraphemePos(r.buffer, r.viewEnd)
 		}
 	} else if r.bufferPos > r.viewEnd {
 		r.viewEnd = r.bufferPos
-		for r.viewOverflow() {
-			r.viewStart += 1
+		for r.viewOverflow() && r.viewStart < r.viewEnd {
+			r.viewStart = nextGraphemePos(r.buffer, r.viewStart)
 		}
 	} else if r.viewOverflow() {
+		// the view shrank (e.g. after a resize), the cursor must stay inside it
 		r.viewEnd = r.bufferLen()
 
-		for r.viewOverflow() {
-			r.viewEnd -= 1
+		for r.viewOverflow() && r.viewEnd > r.bufferPos {
+			r.viewEnd = prevGraphemePos(r.buffer, r.viewEnd)
+		}
+
+		for r.viewOverflow() && r.viewStart < r.viewEnd {
+			r.viewStart = nextGraphemePos(r.buffer, r.viewStart)
 		}
 	} else {
 		for !r.viewOverflow() && r.viewEnd < r.bufferLen() {
-			r.viewEnd += 1
+			r.viewEnd = nextGraphemePos(r.buffer, r.viewEnd)
 		}
 
-		for r.viewOverflow() {
-			r.viewEnd -= 1
+		for r.viewOverflow() && r.viewEnd > r.viewStart {
+			r.viewEnd = prevGraphemePos(r.buffer, r.viewEnd)
 		}
 	}
 }
@@ -627,21 +810,22 @@ func (r *Repl) force(newBuffer []byte, bufferPos int) {
 
 	r.clearStatus()
 
-	r.log("overflow? %d vs %d\n", calcHeight(newBuffer, r.promptLen(), r.getWidth()), r.innerHeight())
-	if calcHeight(newBuffer, r.promptLen(), r.getWidth()) > r.innerHeight() {
+	newHeight := calcHeight(newBuffer, r.promptLen(), r.continuationLen(), r.getWidth())
+
+	r.log("overflow? %d vs %d\n", newHeight, r.innerHeight())
+	if newHeight > r.innerHeight() {
 		viewStart_, viewEnd_ := r.viewStart, r.viewEnd
 		r.clearScreen()
 		r.buffer = newBuffer
-		r.bufferPos = bufferPos
+		r.bufferPos = snapGraphemePos(newBuffer, bufferPos)
 		r.viewStart, r.viewEnd = viewStart_, viewEnd_
 		r.log("viewStart: %d, viewEnd: %d\n", r.viewStart, r.viewEnd)
 		r.adjustBufferView()
 
 		r.log("writing bytes from %d to %d (instead of 0 to %d) (bpos: %d)\n", r.viewStart, r.viewEnd, r.bufferLen(), r.bufferPos)
 
-		for _, b := range r.buffer[r.viewStart:r.viewEnd] {
-			r.writeByte(b)
-		}
+		r.spans = r.highlightBuffer()
+		r.writeBuffer(r.viewStart, r.viewEnd)
 
 		r.syncCursor()
 		// what is the appropriate bufferOffset? The minimal movement to keep the /move
@@ -651,11 +835,7 @@ func (r *Repl) force(newBuffer []byte, bufferPos int) {
 		// TODO: writeBytes instead
 		r.addBytesToBuffer(newBuffer)
 
-		if bufferPos >= r.bufferLen() {
-			bufferPos = r.bufferLen()
-		}
-
-		r.bufferPos = bufferPos
+		r.bufferPos = snapGraphemePos(r.buffer, bufferPos)
 
 		r.log("bufferPos: %d, bufferLen: %d, width: %d\n", r.bufferPos, len(r.buffer), r.getWidth())
 		r.syncCursor()
@@ -665,23 +845,52 @@ func (r *Repl) force(newBuffer []byte, bufferPos int) {
 }
 
 func (r *Repl) syncCursor() {
-	x, y := r.cursorCoord(-1)
-	moveCursorTo(x, y)
+	r.syncCursorTo(-1)
+}
+
+func (r *Repl) syncCursorTo(bufferPos int) {
+	x, y := r.cursorCoord(bufferPos)
+	moveCursorTo(r.term, x, y)
+}
+
+// incomplete input is continued on the next line, instead of being evaluated
+func (r *Repl) isComplete() bool {
+	if v, ok := r.handler.(Validator); ok {
+		return v.IsComplete(string(r.buffer))
+	}
+
+	return true
+}
+
+func (r *Repl) insertNewline() {
+	r.clearStatus()
+	r.addBytesToBuffer([]byte{'\n'})
+	r.writeStatus()
 }
 
 func (r *Repl) evalBuffer() {
+	r.clearSuggestion()
+
+	if r.bufferPos < r.bufferLen() {
+		// the output starts below the last line of the buffer, not below the cursor
+		r.bufferPos = r.bufferLen()
+		r.syncCursorOverflow()
+	}
+
 	r.clearStatus()
 
 	r.newLine()
 
-	// input that is sent to stdin while the handler is blocking, is returned the next time we read bytes from the stdinreader, followed by a sequence indicating the new cursor position (due to queryCursorPos() being called below), so the routine that handles the cursor pos query should also handle any preceding bytes
-	out := r.handler.Eval(strings.TrimSpace(string(r.buffer)))
+	// keystrokes received while the handler is blocking are queued, and handled once the new prompt position is known (see queryPromptRow() below)
+	r.evaluating = true
+	out := r.eval(strings.TrimSpace(string(r.buffer)))
+	r.evaluating = false
 
-	if len(out) > 0 {
+	if len(out) > 0 && !r.quitRequested() {
 		outLines := strings.Split(out, "\n")
 
 		for _, outLine := range outLines {
-			fmt.Print(outLine)
+			fmt.Fprint(r.term, outLine)
 			r.newLine()
 		}
 	}
@@ -691,9 +900,75 @@ func (r *Repl) evalBuffer() {
 
 	r.backup = nil
 
+	r.resetUndo()
+
+	if r.vi != nil {
+		r.vi.reset()
+	}
+
+	if r.quitRequested() {
+		// Quit was called by the handler
+		return
+	}
+
+	r.printPromptHeader()
 	r.resetBuffer()
 
-	queryCursorPos()
+	r.queryPromptRow()
+}
+
+// the handler runs in a separate goroutine, so that events (e.g. calls to MakeRaw and UnmakeRaw by the handler) can be applied in the meantime
+// if the handler implements ContextHandler: keep reading keystrokes and cancel the evaluation on CTRL-C
+func (r *Repl) eval(buffer string) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, isContextHandler := r.handler.(ContextHandler)
+
+	done := make(chan string, 1)
+
+	go func() {
+		if isContextHandler {
+			done <- h.EvalContext(ctx, buffer)
+		} else {
+			done <- r.handler.Eval(buffer)
+		}
+	}()
+
+	// a plain handler might run interactive subprocesses, so stdin is only read for a ContextHandler
+	readInput := isContextHandler
+
+	for {
+		var input <-chan []byte
+		var inputErrs <-chan error
+
+		if readInput {
+			r.reader.read()
+
+			input, inputErrs = r.reader.bytes, r.reader.errs
+		}
+
+		select {
+		case out := <-done:
+			return out
+		case fn := <-r.events:
+			fn()
+		case err := <-inputErrs:
+			// let the evaluation finish, Loop returns afterwards
+			r.fail(&InputError{err})
+			cancel()
+			readInput = false
+		case bts := <-input:
+			for _, k := range r.parser.feed(bts) {
+				if k.isCtrl('c') {
+					r.log("cancelling evaluation\n")
+					cancel()
+				} else {
+					r.pending = append(r.pending, k)
+				}
+			}
+		}
+	}
 }
 
 func (r *Repl) redraw() {
@@ -733,7 +1008,7 @@ func (r *Repl) moveLeftOneChar() {
 		r.stopSearch()
 	} else {
 		if r.bufferPos > 0 {
-			r.bufferPos -= 1
+			r.bufferPos = prevGraphemePos(r.buffer, r.bufferPos)
 
 			if r.overflow() {
 				if r.bufferPos <= r.viewStart {
@@ -752,7 +1027,7 @@ func (r *Repl) moveRightOneChar() {
 		r.stopSearch()
 	} else {
 		if r.bufferPos < r.bufferLen() {
-			r.bufferPos += 1
+			r.bufferPos = nextGraphemePos(r.buffer, r.bufferPos)
 
 			if r.overflow() {
 				if r.bufferPos >= r.viewEnd {
@@ -766,44 +1041,126 @@ func (r *Repl) moveRightOneChar() {
 	}
 }
 
-func (r *Repl) moveUpOneLine() {
-	x, y := r.cursorCoord(-1)
+func lineStart(buffer []byte, pos int) int {
+	return bytes.LastIndexByte(buffer[0:pos], '\n') + 1
+}
 
-	h0 := r.calcViewStartHeight()
-	_, y0 := r.cursorCoord(r.viewStart)
+func lineEnd(buffer []byte, pos int) int {
+	if i := bytes.IndexByte(buffer[pos:], '\n'); i >= 0 {
+		return pos + i
+	}
 
-	if ((h0 > 0) && (y >= y0)) || y > y0 {
-		// problem is that y is in view space, and
-		r.bufferPos = r.calcBufferPos(x, y-1)
+	return len(buffer)
+}
 
-		if r.overflow() {
-			if r.bufferPos <= r.viewStart {
-				r.redraw()
-				return
-			}
+// position in the line starting at start, that is closest to the display column col
+func columnPos(buffer []byte, start int, col int) int {
+	end := lineEnd(buffer, start)
+	pos := end
+
+	x := 0
+	forEachGrapheme(buffer[start:end], func(gStart, gStop, width int) bool {
+		if x+width > col {
+			pos = start + gStart
+			return false
 		}
 
-		r.syncCursor()
+		x += width
+		return true
+	})
+
+	return pos
+}
+
+// consecutive vertical movements try to keep the column where the first one started
+func (r *Repl) goalColumn() int {
+	switch r.prevAction {
+	case "moveUpOneLine", "moveDownOneLine", "moveUpOrHistoryBack", "moveDownOrHistoryForward":
+		return r.goalCol
 	}
+
+	start := lineStart(r.buffer, r.bufferPos)
+	r.goalCol = displayWidth(string(r.buffer[start:r.bufferPos]))
+
+	return r.goalCol
 }
 
-func (r *Repl) moveDownOneLine() {
-	x, y := r.cursorCoord(-1)
+// a vertical movement scrolls the view by whole lines
+func (r *Repl) moveToLinePos(pos int) {
+	r.bufferPos = pos
+
+	if !r.overflow() {
+		r.syncCursor()
+		return
+	}
+
+	if _, y := r.cursorCoord(-1); pos >= r.viewStart && pos <= r.viewEnd && y-r.promptRow < r.innerHeight() {
+		r.syncCursor()
+		return
+	}
 
-	_, ye := r.cursorCoord(r.viewEnd)
-	he := r.calcViewEndHeight()
+	if pos < r.viewStart {
+		r.viewStart = lineStart(r.buffer, pos)
+		r.viewEnd = r.bufferLen()
 
-	if y < ye || (y <= ye && he > 0) {
-		r.bufferPos = r.calcBufferPos(x, y+1)
+		for r.viewOverflow() && r.viewEnd > r.viewStart {
+			r.viewEnd = prevGraphemePos(r.buffer, r.viewEnd)
+		}
+	} else {
+		r.viewEnd = lineEnd(r.buffer, pos)
 
-		if r.overflow() {
-			if r.bufferPos >= r.viewEnd {
-				r.redraw()
-				return
+		for r.viewOverflow() && r.viewStart < r.viewEnd {
+			if next := lineEnd(r.buffer, r.viewStart) + 1; next <= lineStart(r.buffer, pos) {
+				r.viewStart = next
+			} else {
+				r.viewStart = nextGraphemePos(r.buffer, r.viewStart)
 			}
 		}
+	}
 
-		r.syncCursor()
+	r.redraw()
+}
+
+// returns false if the cursor is on the first line of the buffer
+func (r *Repl) moveUpOneLine() bool {
+	start := lineStart(r.buffer, r.bufferPos)
+	if start == 0 {
+		return false
+	}
+
+	col := r.goalColumn()
+
+	r.moveToLinePos(columnPos(r.buffer, lineStart(r.buffer, start-1), col))
+
+	return true
+}
+
+// returns false if the cursor is on the last line of the buffer
+func (r *Repl) moveDownOneLine() bool {
+	end := lineEnd(r.buffer, r.bufferPos)
+	if end == r.bufferLen() {
+		return false
+	}
+
+	col := r.goalColumn()
+
+	r.moveToLinePos(columnPos(r.buffer, end+1, col))
+
+	return true
+}
+
+// Up moves between the lines of a multi-line buffer, and only recalls the previous history entry on the first line
+func (r *Repl) moveUpOrHistoryBack() {
+	if r.searchActive() || !r.moveUpOneLine() {
+		r.action = "historyBack"
+		r.historyBack()
+	}
+}
+
+func (r *Repl) moveDownOrHistoryForward() {
+	if r.searchActive() || !r.moveDownOneLine() {
+		r.action = "historyForward"
+		r.historyForward()
 	}
 }
 
@@ -843,10 +1200,10 @@ func (r *Repl) moveRightOnePhrase() {
 func (r *Repl) appendToHistory(entry []byte) {
 	n := len(r.history)
 
-	if n == 0 {
-		r.history = append(r.history, entry)
-	} else if string(r.history[n-1]) != string(entry) {
+	if n == 0 || string(r.history[n-1]) != string(entry) {
 		r.history = append(r.history, entry)
+
+		r.writeHistoryEntry(entry)
 	}
 }
 
@@ -921,7 +1278,12 @@ func (r *Repl) startReverseSearch() {
 	r.writeStatus()
 }
 
-func (r *Repl) tab() {
+func (r *Repl) tab(secondTab bool) {
+	if completer, ok := r.handler.(Completer); ok {
+		r.complete(completer, secondTab)
+		return
+	}
+
 	prec := string(r.buffer[0:r.bufferPos])
 
 	extra := r.handler.Tab(prec)
@@ -931,16 +1293,46 @@ func (r *Repl) tab() {
 	}
 }
 
+// the actual cleanup is done by Loop, after the current keystroke has been handled
 func (r *Repl) quit() {
+	r.fail(nil)
+}
+
+// quit with an error, only the first reason for quitting is kept
+func (r *Repl) fail(err error) {
+	r.quitOnce.Do(func() {
+		r.err = err
+		close(r.quitting)
+	})
+}
+
+func (r *Repl) quitRequested() bool {
+	select {
+	case <-r.quitting:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Repl) cleanUp() {
+	r.clearSuggestion()
 	r.clearAfterPrompt()
 
-	fmt.Print("\n\r")
+	fmt.Fprint(r.term, "\n\r")
 
-	moveToRowStart()
+	moveToRowStart(r.term)
 
-	r.UnmakeRaw()
+	// the prompt row was never known, so these weren't printed yet
+	for _, msg := range r.pendingMsgs {
+		r.writeRawLines(msg + "\n")
+	}
+
+	r.unmakeRaw()
 
-	os.Exit(0)
+	r.stopSizeChanges()
+
+	r.closeHistory()
 }
 
 func (r *Repl) redrawScreen() {
@@ -949,13 +1341,20 @@ func (r *Repl) redrawScreen() {
 
 	r.clearScreen()
 
+	// the lines above the last line of the prompt are only redrawn if everything fits
+	if h := r.promptHeaderHeight(); h > 0 && h+calcHeight(buffer, r.promptLen(), r.continuationLen(), r.getWidth()) <= r.innerHeight() {
+		clearRow(r.term)
+		r.printPromptHeader()
+		r.updatePromptRow(h)
+	}
+
 	r.force(buffer, bufferPos)
 }
 
 func (r *Repl) clearScreen() {
-	clearScreen()
+	clearScreen(r.term)
 
-	moveToScreenStart()
+	moveToScreenStart(r.term)
 
 	r.updatePromptRow(0)
 
@@ -966,7 +1365,7 @@ func (r *Repl) backspaceActiveBuffer() {
 	if r.searchActive() {
 		n := len(r.filter)
 		if n > 0 {
-			r.filter = r.filter[0 : n-1]
+			r.filter = r.filter[0:prevGraphemePos(r.filter, n)]
 		}
 
 		r.updateSearchResult()
@@ -982,17 +1381,18 @@ func (r *Repl) backspace() {
 
 	if n > 0 {
 		if r.bufferPos > 0 {
-			newPos := r.bufferPos - 1
-			newBuffer := append(r.buffer[0:newPos], r.buffer[newPos+1:len(r.buffer)]...)
+			newPos := prevGraphemePos(r.buffer, r.bufferPos)
+			newBuffer := append(r.buffer[0:newPos], r.buffer[r.bufferPos:len(r.buffer)]...)
 
 			_, y0 := r.cursorCoord(-1)
 			x1, y1 := r.cursorCoord(newPos)
 
 			if y0 == y1 && r.bufferPos == len(r.buffer) && !r.overflow() {
-				moveToCol(x1)
-				clearRowAfterCursor()
+				moveToCol(r.term, x1)
+				clearRowAfterCursor(r.term)
 				r.buffer = newBuffer
 				r.bufferPos = newPos
+				r.restyle()
 			} else {
 				r.force(newBuffer, newPos)
 			}
@@ -1007,10 +1407,7 @@ func (r *Repl) deleteChar() {
 		if r.bufferPos < r.bufferLen() {
 			newBuffer := make([]byte, 0)
 			newBuffer = append(newBuffer, r.buffer[0:r.bufferPos]...)
-
-			if r.bufferPos < r.bufferLen()-1 {
-				newBuffer = append(newBuffer, r.buffer[r.bufferPos+1:]...)
-			}
+			newBuffer = append(newBuffer, r.buffer[nextGraphemePos(r.buffer, r.bufferPos):]...)
 
 			newPos := r.bufferPos
 
@@ -1023,7 +1420,7 @@ func (r *Repl) clearToEnd() {
 	if r.bufferPos != r.bufferLen() {
 		newBuffer := r.buffer[0:r.bufferPos]
 
-		r.prevDel = r.buffer[r.bufferPos:]
+		r.kill(r.buffer[r.bufferPos:], false)
 
 		r.force(newBuffer, r.bufferPos)
 	}
@@ -1033,20 +1430,20 @@ func (r *Repl) clearToStart() {
 	if r.bufferPos > 0 {
 		newBuffer := r.buffer[r.bufferPos:]
 
-		r.prevDel = r.buffer[0:r.bufferPos]
+		r.kill(r.buffer[0:r.bufferPos], true)
 
 		r.force(newBuffer, 0)
 	}
 }
 
-func (r *Repl) phraseStartPositions() []int {
-	if len(r.buffer) == 0 {
+func (r *Repl) phraseStartPositions(buffer []byte) []int {
+	if len(buffer) == 0 {
 		return []int{0}
 	}
 
 	re := r.phraseRe
 
-	indices := re.FindAllIndex(r.buffer, -1)
+	indices := re.FindAllIndex(buffer, -1)
 
 	res := make([]int, 0)
 
@@ -1059,34 +1456,37 @@ func (r *Repl) phraseStartPositions() []int {
 
 		res = append(res, start, stop)
 
-		if i == len(indices)-1 && stop != len(r.buffer) {
-			res = append(res, len(r.buffer))
+		if i == len(indices)-1 && stop != len(buffer) {
+			res = append(res, len(buffer))
 		}
 	}
 
-	if len(res) == 0 || res[len(res)-1] != len(r.buffer) {
-		res = append(res, len(r.buffer))
+	if len(res) == 0 || res[len(res)-1] != len(buffer) {
+		res = append(res, len(buffer))
 	}
 
 	return res
 }
 
 func (r *Repl) nextPhrasePos() (int, bool) {
-	var res int
-	if r.bufferPos == r.bufferLen() {
-		res = r.bufferLen()
-	} else {
-		indices := r.phraseStartPositions()
+	res := r.phrasePosAfter(r.buffer, r.bufferPos)
 
-		for _, idx := range indices {
-			if idx > r.bufferPos {
-				res = idx
-				break
-			}
+	return res, res != r.bufferPos
+}
+
+// also used for the text of a suggestion, that isn't part of the buffer yet
+func (r *Repl) phrasePosAfter(buffer []byte, pos int) int {
+	if pos == len(buffer) {
+		return pos
+	}
+
+	for _, idx := range r.phraseStartPositions(buffer) {
+		if idx > pos {
+			return idx
 		}
 	}
 
-	return res, res != r.bufferPos
+	return 0
 }
 
 func (r *Repl) prevPhrasePos() (int, bool) {
@@ -1094,7 +1494,7 @@ func (r *Repl) prevPhrasePos() (int, bool) {
 	if r.bufferPos == 0 {
 		res = 0
 	} else {
-		indices := r.phraseStartPositions()
+		indices := r.phraseStartPositions(r.buffer)
 
 		for i := len(indices) - 1; i >= 0; i-- {
 			idx := indices[i]
@@ -1111,11 +1511,13 @@ func (r *Repl) prevPhrasePos() (int, bool) {
 func (r *Repl) clearOnePhraseLeft() {
 	idx, ok := r.prevPhrasePos()
 	if ok {
-		newBuffer := append(r.buffer[0:idx], r.buffer[r.bufferPos:]...)
+		r.kill(r.buffer[idx:r.bufferPos], true)
 
-		newPos := idx
+		newBuffer := make([]byte, 0)
+		newBuffer = append(newBuffer, r.buffer[0:idx]...)
+		newBuffer = append(newBuffer, r.buffer[r.bufferPos:]...)
 
-		r.prevDel = r.buffer[idx:r.bufferPos]
+		newPos := idx
 
 		_, y0 := r.cursorCoord(-1)
 		x1, y1 := r.cursorCoord(newPos)
@@ -1124,7 +1526,8 @@ func (r *Repl) clearOnePhraseLeft() {
 			r.bufferPos = newPos
 			r.buffer = newBuffer
 			r.syncCursor()
-			clearRowAfterCursor()
+			clearRowAfterCursor(r.term)
+			r.restyle()
 		} else {
 			r.force(newBuffer, newPos)
 		}
@@ -1140,32 +1543,12 @@ func (r *Repl) clearOnePhraseRight() {
 
 		newPos := r.bufferPos
 
-		r.prevDel = r.buffer[r.bufferPos:idx]
+		r.kill(r.buffer[r.bufferPos:idx], false)
 
 		r.force(newBuffer, newPos)
 	}
 }
 
-func (r *Repl) cleanAndAddToBuffer(msg []byte) {
-	// remove bad chars
-	// XXX: what about unicode?
-	filtered := make([]byte, 0)
-
-	for _, c := range msg {
-		if c == '\t' {
-			filtered = append(filtered, ' ')
-		} else if c >= 32 && c < 127 {
-			filtered = append(filtered, c)
-		}
-	}
-
-	r.addBytesToBuffer(filtered)
-}
-
-func (r *Repl) insertPrevDel() {
-	r.addBytesToBuffer(r.prevDel)
-}
-
 func (r *Repl) updatePromptRow(row int) {
 	if row >= r.getHeight() {
 		row = r.getHeight() - 1
@@ -1178,17 +1561,25 @@ func (r *Repl) updatePromptRow(row int) {
 	r.log("prompt row %d/%d\n", r.promptRow, r.innerHeight()-1)
 }
 
-func (r *Repl) writeByte(b byte) {
-	if b == '\n' {
+func (r *Repl) writeBytes(bs []byte) {
+	for len(bs) > 0 {
+		i := bytes.IndexByte(bs, '\n')
+		if i < 0 {
+			// should be printable characters
+			r.term.Write(bs)
+			return
+		}
+
+		r.term.Write(bs[0:i])
 		r.newLine()
-	} else {
-		// should be a printable character
-		fmt.Fprintf(os.Stdout, "%c", b)
+		fmt.Fprint(r.term, r.continuationPrompt())
+
+		bs = bs[i+1:]
 	}
 }
 
 func (r *Repl) newLine() {
-	fmt.Fprintf(os.Stdout, "\n\r")
+	fmt.Fprintf(r.term, "\n\r")
 
 	// every newLine means the status line is pushed below
 }
@@ -1214,11 +1605,16 @@ func (r *Repl) statusFields() (string, string) {
 		vis = fmt.Sprintf("%d", int(float64(r.bufferPos)/float64(r.bufferLen())*100)) + "%"
 	}
 
+	if r.vi != nil {
+		vis = r.vi.modeName() + "  " + vis
+	}
+
 	return cwd, vis
 }
 
+// the status bar needs a row of its own below the prompt
 func (r *Repl) statusVisible() bool {
-	if r.getWidth() < 10 {
+	if r.getWidth() < 10 || r.getHeight() < 2 {
 		return false
 	} else {
 		return true
@@ -1227,9 +1623,9 @@ func (r *Repl) statusVisible() bool {
 
 func (r *Repl) clearStatus() {
 	if r.statusVisible() {
-		moveCursorTo(0, r.getHeight()-1)
+		moveCursorTo(r.term, 0, r.getHeight()-1)
 
-		clearRow()
+		clearRow(r.term)
 
 		r.syncCursor()
 	}
@@ -1254,7 +1650,8 @@ func (r *Repl) filterStatus() string {
 	} else if cur != -1 {
 		return fmt.Sprintf("%d/%d matches", cur+1, tot)
 	} else {
-		panic("unexpected")
+		// current buffer isn't one of the matches
+		return fmt.Sprintf("%d matches", tot)
 	}
 }
 
@@ -1266,51 +1663,61 @@ func (r *Repl) writeStatus() {
 
 	r.boundPromptRow()
 
-	moveCursorTo(0, r.getHeight()-1)
+	moveCursorTo(r.term, 0, r.getHeight()-1)
 
 	w := r.getWidth()
-	if r.searchActive() {
-		pref := "Reverse-search: "
-		fmt.Print(pref)
-		fmt.Print(string(r.filter)) // cursor stays here
-
-		// print some status about the matches
-		if len(r.filter) > 0 && w > len(r.filter)+len(pref)+10 {
-			info := r.filterStatus()
-
-			for i := 0; i < w-len(info)-len(pref)-len(r.filter); i++ {
-				fmt.Print(" ")
-			}
-
-			fmt.Print(info)
-
-			moveToCol(len(pref) + len(r.filter))
+	if r.pickerActive() {
+		r.writeQueryStatus("Fuzzy-search: ", r.picker.query, r.pickerStatus())
+	} else if r.searchActive() {
+		info := ""
+		if len(r.filter) > 0 {
+			info = r.filterStatus()
 		}
+
+		r.writeQueryStatus("Reverse-search: ", r.filter, info)
 	} else {
 		left, right := r.statusFields()
 
 		// start highlighting
-		highlight()
+		highlight(r.term)
 
-		if len(left) > w-len(right) {
-			left = left[0 : w-len(right)]
-		}
+		left = truncateToWidth(left, w-len(right))
 
-		fmt.Print(left)
+		fmt.Fprint(r.term, left)
 
-		for i := 0; i < w-len(left)-len(right); i++ {
-			fmt.Print(" ")
+		for i := 0; i < w-displayWidth(left)-len(right); i++ {
+			fmt.Fprint(r.term, " ")
 		}
 
-		fmt.Print(right)
+		fmt.Fprint(r.term, right)
 
 		// end highlighting
-		resetDecorations()
+		resetDecorations(r.term)
 
 		r.syncCursor()
 	}
 }
 
+// the cursor stays after the query
+func (r *Repl) writeQueryStatus(pref string, query []byte, info string) {
+	w := r.getWidth()
+
+	fmt.Fprint(r.term, pref)
+	fmt.Fprint(r.term, string(query)) // cursor stays here
+
+	// print some status about the matches
+	queryWidth := displayWidth(string(query))
+	if info != "" && w > queryWidth+len(pref)+10 {
+		for i := 0; i < w-len(info)-len(pref)-queryWidth; i++ {
+			fmt.Fprint(r.term, " ")
+		}
+
+		fmt.Fprint(r.term, info)
+
+		moveToCol(r.term, len(pref)+queryWidth)
+	}
+}
+
 // use a simple match criterium now, could be improved
 func (r *Repl) filterMatches(bs []byte) bool {
 	return strings.Contains(string(bs), string(r.filter))
@@ -1342,96 +1749,189 @@ func (r *Repl) updateSearchResult() {
 
 // Start the REPL loop.
 //
-// Loop sets the terminal to raw mode, so any further calls to fmt.Print or similar, might not behave as expected and can garble your REPL.
+// Loop sets the terminal to raw mode, so any further calls to fmt.Print or similar, might not behave as expected and can garble your REPL. Use Printf to print messages while Loop is running.
+//
+// Loop returns ErrQuit after the REPL is quit (with CTRL-D or by calling Quit), at which point the terminal is no longer in raw mode. A Repl can't be restarted once it has been quit.
+// If the terminal fails, Loop returns an *InputError or a *SizeError instead, also after restoring the terminal state.
+//
+// If the input isn't a terminal (e.g. a file or a pipe), Loop evaluates every line of input and prints the outputs without prompt, status bar or escape sequences. In that case Loop returns ErrQuit at the end of the input.
 func (r *Repl) Loop() error {
+	if !r.term.IsTerminal() {
+		return r.plainLoop()
+	}
+
+	if err := r.openHistory(); err != nil {
+		return err
+	}
+
 	// the terminal needs to be in raw mode, so we can intercept the control sequences
 	// (the default canonical mode isn't good enough for repl's)
-	if err := r.MakeRaw(); err != nil {
+	if err := r.makeRaw(); err != nil {
 		return err
 	}
 
-	r.reader.start()
+	if err := r.notifySizeChange(); err != nil {
+		r.unmakeRaw()
+		r.closeHistory()
+		return err
+	}
 
-	r.notifySizeChange()
+	r.reader.start(r.quitting)
+
+	atomic.StoreInt32(&r.state, _RUNNING)
+
+	defer func() {
+		atomic.StoreInt32(&r.state, _STOPPED)
+		close(r.stopped)
+	}()
 
+	r.printPromptHeader()
 	r.printPrompt()
 
-	queryCursorPos() // get initial prompt position
+	r.queryPromptRow() // get initial prompt position
 
-	// loop forever
-	for {
+	for !r.quitRequested() {
 		r.reader.read()
 
-		bts := <-r.reader.bytes
+		// an incomplete escape sequence that isn't completed in time is a lone ESC (or ALT + a key)
+		var escapeTimeout <-chan time.Time
+		if r.parser.pending() {
+			escapeTimeout = time.After(ESCAPE_TIMEOUT)
+		}
+
+		var queryTimeout <-chan time.Time
+		if r.queried {
+			queryTimeout = time.After(time.Until(r.queriedAt.Add(CURSOR_QUERY_TIMEOUT)))
+		}
 
-		r.dispatch(bts)
+		select {
+		case bts := <-r.reader.bytes:
+			r.dispatchKeys(r.parser.feed(bts))
+		case <-escapeTimeout:
+			r.dispatchKeys(r.parser.flush())
+		case <-queryTimeout:
+			r.queryTimedOut()
+		case err := <-r.reader.errs:
+			r.fail(&InputError{err})
+		case <-r.sizeChanges:
+			r.handleSizeChange()
+		case fn := <-r.events:
+			fn()
+		case <-r.quitting:
+		}
 	}
 
-	return nil
+	r.cleanUp()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	return ErrQuit
 }
 
-// Exit the REPL program cleanly. Performs the following steps:
+// Request the REPL to quit, this method can be called from the Handler or from any other goroutine. Once the current keystroke or evaluation is handled, Loop performs the following steps:
 //  1. cleans the screen
 //  2. returns the cursor to the appropriate position
 //  3. unsets terminal raw mode
+//  4. closes the history file
+//  5. returns ErrQuit
 //
-// Important: use this method instead of os.Exit.
+// Important: use this method instead of os.Exit, and exit your program after Loop returns.
 func (r *Repl) Quit() {
 	r.quit()
 }
 
 // Unset the raw mode in case you want to run a curses-like command inside your REPL session (e.g. vi or top). Remember to call MakeRaw after the command finishes.
 func (r *Repl) UnmakeRaw() {
-	r.onEnd()
+	r.do(r.unmakeRaw)
+}
+
+func (r *Repl) unmakeRaw() {
+	if r.onEnd != nil {
+		r.onEnd()
+	}
 
 	r.onEnd = nil
 }
 
 // Explicitely set the terminal back to raw mode after a call to UnmakeRaw.
 func (r *Repl) MakeRaw() error {
-	// we need the term package as a platform independent way of setting the connected terminal emulator to raw mode
-	fd := int(os.Stdin.Fd())
+	var err error
 
-	oldState, err := term.MakeRaw(fd)
-	if err != nil {
+	r.do(func() {
+		err = r.makeRaw()
+	})
+
+	return err
+}
+
+func (r *Repl) makeRaw() error {
+	if err := r.term.MakeRaw(); err != nil {
 		return err
 	}
 
+	enableBracketedPaste(r.term)
+
 	r.onEnd = func() {
-		term.Restore(fd, oldState)
+		disableBracketedPaste(r.term)
+		r.term.Restore()
 	}
 
 	return nil
 }
 
+// Read a line of user input, e.g. to ask for a confirmation or a password inside Handler.Eval. Reading stops at RETURN, or when the input fails.
 func (r *Repl) ReadLine(echo bool) string {
+	if r.lineReader != nil {
+		line, err := r.readPlainLine()
+		if err != nil && err != io.EOF {
+			r.fail(&InputError{err})
+		}
+
+		return line
+	}
+
 	buffer := make([]byte, 0)
 
+	// the Loop goroutine might be decoding keystrokes in the meantime, so use a separate parser
+	parser := newKeyParser()
+
 	for {
 		r.reader.read()
 
-		bts := <-r.reader.bytes
+		var bts []byte
+		select {
+		case bts = <-r.reader.bytes:
+		case err := <-r.reader.errs:
+			// Loop returns the error once the handler returns
+			r.fail(&InputError{err})
+			return string(buffer)
+		}
 
-		// a mini version of dispatch
-		if len(bts) == 1 && bts[0] == 13 {
-			if echo {
-				fmt.Print("\n\r")
-			}
-			break
-		} else {
-			for _, b := range bts {
-				if b == 27 {
-					break
-				} else if b >= 32 {
-					if echo {
-						fmt.Print(string([]byte{b}))
-					}
+		// a mini version of dispatch, escape sequences are ignored
+		for _, k := range parser.feed(bts) {
+			if k.is(KEY_ENTER, 0) {
+				if echo {
+					fmt.Fprint(r.term, "\n\r")
+				}
+
+				return string(buffer)
+			} else if k.isText() {
+				if echo {
+					fmt.Fprint(r.term, string(k.Rune))
+				}
 
-					buffer = append(buffer, b)
+				buffer = append(buffer, string(k.Rune)...)
+			} else if k.Code == keyPaste {
+				text := cleanInput([]byte(k.text))
+
+				if echo {
+					fmt.Fprint(r.term, string(text))
 				}
+
+				buffer = append(buffer, text...)
 			}
 		}
 	}
-
-	return string(buffer)
 }
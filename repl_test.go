@@ -0,0 +1,362 @@
+package repl_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	repl "github.com/openengineer/go-repl"
+	"github.com/openengineer/go-repl/repltest"
+)
+
+type echoHandler struct{}
+
+func (h *echoHandler) Prompt() string {
+	return "> "
+}
+
+func (h *echoHandler) Eval(buffer string) string {
+	return buffer
+}
+
+func (h *echoHandler) Tab(buffer string) string {
+	return ""
+}
+
+type completingHandler struct {
+	echoHandler
+	words []string
+}
+
+func (h *completingHandler) Complete(buffer string, pos int) repl.Completion {
+	start := strings.LastIndex(buffer[0:pos], " ") + 1
+
+	c := repl.Completion{Start: start, End: pos, Candidates: nil}
+
+	for _, word := range h.words {
+		if strings.HasPrefix(word, buffer[start:pos]) {
+			c.Candidates = append(c.Candidates, repl.Candidate{Text: word})
+		}
+	}
+
+	return c
+}
+
+func start(handler repl.Handler, width, height int) *repltest.Harness {
+	h := repltest.New(handler, width, height)
+
+	h.Start()
+
+	return h
+}
+
+func assertRows(t *testing.T, h *repltest.Harness, rows ...string) {
+	t.Helper()
+
+	for y, row := range rows {
+		if got := h.Screen().Row(y); got != row {
+			t.Errorf("row %d: expected %q, got %q\n%s", y, row, got, h.Screen())
+		}
+	}
+}
+
+func assertCursor(t *testing.T, h *repltest.Harness, x, y int) {
+	t.Helper()
+
+	if gotX, gotY := h.Cursor(); gotX != x || gotY != y {
+		t.Errorf("expected cursor at %d,%d, got %d,%d\n%s", x, y, gotX, gotY, h.Screen())
+	}
+}
+
+func assertStatus(t *testing.T, h *repltest.Harness, vis string) {
+	t.Helper()
+
+	if status := h.StatusBar(); !strings.HasSuffix(status, vis) {
+		t.Errorf("expected status bar ending with %q, got %q", vis, status)
+	}
+}
+
+// Loop must return once the REPL is quit
+func quit(t *testing.T, h *repltest.Harness) error {
+	t.Helper()
+
+	h.Repl.Quit()
+
+	select {
+	case err := <-h.Done():
+		return err
+	case <-time.After(repltest.WAIT_TIMEOUT):
+		t.Fatalf("Loop didn't return\n%s", h.Screen())
+		return nil
+	}
+}
+
+func TestTyping(t *testing.T) {
+	h := start(&echoHandler{}, 20, 5)
+
+	// trailing spaces aren't included in the rows
+	assertRows(t, h, ">")
+	assertCursor(t, h, 2, 0)
+
+	h.Type("hello")
+	assertRows(t, h, "> hello")
+	assertCursor(t, h, 7, 0)
+	assertStatus(t, h, "All")
+
+	h.Keys(repltest.LEFT, repltest.LEFT)
+	h.Type("X")
+	assertRows(t, h, "> helXlo")
+	assertCursor(t, h, 6, 0)
+
+	h.Keys(repltest.BACKSPACE, repltest.CTRL_A)
+	assertRows(t, h, "> hello")
+	assertCursor(t, h, 2, 0)
+
+	h.Keys(repltest.ENTER)
+	assertRows(t, h, "> hello", "hello", ">")
+	assertCursor(t, h, 2, 2)
+}
+
+func TestWrapping(t *testing.T) {
+	h := start(&echoHandler{}, 12, 5)
+
+	// the cursor moves to the next row once the first row is full
+	h.Type("abcdefghij")
+	assertRows(t, h, "> abcdefghij", "")
+	assertCursor(t, h, 0, 1)
+
+	h.Type("klm")
+	assertRows(t, h, "> abcdefghij", "klm")
+	assertCursor(t, h, 3, 1)
+
+	h.Keys(repltest.CTRL_A)
+	assertCursor(t, h, 2, 0)
+
+	h.Keys(repltest.CTRL_E)
+	assertCursor(t, h, 3, 1)
+
+	// the rows of the wrapped buffer are cleared when the buffer shrinks
+	h.Keys(repltest.BACKSPACE, repltest.BACKSPACE, repltest.BACKSPACE, repltest.BACKSPACE)
+	assertRows(t, h, "> abcdefghi", "")
+	assertCursor(t, h, 11, 0)
+	assertStatus(t, h, "All")
+}
+
+func TestWideCharacterWrapping(t *testing.T) {
+	h := start(&echoHandler{}, 12, 5)
+
+	// a wide character doesn't fit on the last column of the first row
+	h.Type("abcdefghi世")
+	assertRows(t, h, "> abcdefghi", "世")
+	assertCursor(t, h, 2, 1)
+
+	h.Keys(repltest.LEFT)
+	assertCursor(t, h, 0, 1)
+
+	h.Keys(repltest.LEFT)
+	assertCursor(t, h, 10, 0)
+}
+
+func TestOverflow(t *testing.T) {
+	// 3 rows for the buffer, and the status bar
+	h := start(&echoHandler{}, 10, 4)
+
+	text := strings.Repeat("abcdefghij", 4)
+
+	h.Type(text)
+
+	// the end of the buffer is visible, the prompt is drawn in front of the first visible character
+	assertRows(t, h, "> defghija", "bcdefghija", "bcdefghij")
+	assertCursor(t, h, 9, 2)
+	assertStatus(t, h, "End")
+
+	h.Keys(repltest.CTRL_A)
+	assertRows(t, h, "> abcdefgh", "ijabcdefgh", "ijabcdefg")
+	assertCursor(t, h, 2, 0)
+	assertStatus(t, h, "Start")
+
+	h.Keys(repltest.CTRL_E)
+	assertRows(t, h, "> defghija", "bcdefghija", "bcdefghij")
+	assertCursor(t, h, 9, 2)
+	assertStatus(t, h, "End")
+
+	// the entire buffer is evaluated
+	h.Keys(repltest.ENTER)
+
+	if !strings.Contains(strings.ReplaceAll(h.Screen().String(), "\n", ""), text[len(text)-18:]) {
+		t.Errorf("expected evaluated buffer\n%s", h.Screen())
+	}
+}
+
+func TestResize(t *testing.T) {
+	h := start(&echoHandler{}, 20, 5)
+
+	h.Type("abcdefghijklmnopqrstuvwxyz")
+	assertRows(t, h, "> abcdefghijklmnopqr", "stuvwxyz")
+	assertCursor(t, h, 8, 1)
+
+	// the buffer is redrawn with the new width
+	h.Resize(10, 6)
+	assertRows(t, h, "> abcdefgh", "ijklmnopqr", "stuvwxyz")
+	assertCursor(t, h, 8, 2)
+	assertStatus(t, h, "All")
+
+	// the buffer doesn't fit anymore
+	h.Resize(10, 3)
+	assertStatus(t, h, "End")
+
+	if _, y := h.Cursor(); y > 1 {
+		t.Errorf("cursor on row %d, below the visible buffer", y)
+	}
+
+	h.Resize(20, 5)
+	assertStatus(t, h, "All")
+
+	if x, y := h.Cursor(); x != 8 || h.Screen().Row(y) != "stuvwxyz" {
+		t.Errorf("expected cursor after the end of the buffer, got %d,%d\n%s", x, y, h.Screen())
+	}
+}
+
+func TestStatusBarHidden(t *testing.T) {
+	h := start(&echoHandler{}, 9, 3)
+
+	h.Type("abc")
+	assertRows(t, h, "> abc", "", "")
+
+	// a single row is used for the buffer
+	h.Resize(20, 1)
+	assertRows(t, h, "> abc")
+
+	if err := quit(t, h); err != repl.ErrQuit {
+		t.Errorf("expected ErrQuit, got %v", err)
+	}
+}
+
+func TestTinyTerminal(t *testing.T) {
+	sizes := [][2]int{{80, 1}, {10, 1}, {1, 1}, {1, 5}, {2, 2}, {3, 2}}
+
+	for _, size := range sizes {
+		h := start(&echoHandler{}, 20, 5)
+
+		h.Type("abc")
+		h.Resize(size[0], size[1])
+		h.Type("de世fgh")
+		h.Keys(repltest.CTRL_A, repltest.RIGHT, repltest.UP, repltest.DOWN, repltest.CTRL_E, repltest.BACKSPACE)
+
+		if err := quit(t, h); err != repl.ErrQuit {
+			t.Errorf("%dx%d: expected ErrQuit, got %v", size[0], size[1], err)
+		}
+	}
+}
+
+func TestZeroSize(t *testing.T) {
+	h := start(&echoHandler{}, 20, 5)
+
+	h.Type("abc")
+	h.Resize(0, 0)
+
+	select {
+	case err := <-h.Done():
+		var sizeErr *repl.SizeError
+		if !errors.As(err, &sizeErr) {
+			t.Errorf("expected SizeError, got %v", err)
+		}
+	case <-time.After(repltest.WAIT_TIMEOUT):
+		t.Fatalf("Loop didn't return")
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	h := start(&completingHandler{words: []string{"foobar", "foobaz", "fooqux"}}, 30, 6)
+
+	h.Type("f")
+	h.Keys(repltest.TAB)
+	assertRows(t, h, "> foo", "")
+
+	// the common prefix is still ambiguous, so the next TAB lists the candidates
+	h.Keys(repltest.TAB)
+
+	if row := h.Screen().Row(1); !strings.Contains(row, "foobar") || !strings.Contains(row, "fooqux") {
+		t.Errorf("expected the candidates below the prompt\n%s", h.Screen())
+	}
+}
+
+func startVi(t *testing.T, text string) *repltest.Harness {
+	h := start(&echoHandler{}, 30, 5)
+
+	h.Repl.SetViMode(true)
+	h.Wait()
+
+	h.Type(text)
+	h.Keys(repltest.ESC)
+	assertStatus(t, h, "NORMAL All")
+
+	return h
+}
+
+func TestViDeleteAndPut(t *testing.T) {
+	h := startVi(t, "one two three")
+	assertCursor(t, h, 14, 0)
+
+	h.Type("0dw")
+	assertRows(t, h, "> two three")
+	assertCursor(t, h, 2, 0)
+
+	// the deleted word is put after the last character
+	h.Type("$p")
+	assertRows(t, h, "> two threeone")
+	assertCursor(t, h, 14, 0)
+
+	h.Type("u")
+	assertRows(t, h, "> two three")
+
+	h.Type("u")
+	assertRows(t, h, "> one two three")
+}
+
+func TestViChangeAndRepeat(t *testing.T) {
+	h := startVi(t, "one two three")
+
+	h.Type("0cw")
+	assertStatus(t, h, "INSERT All")
+
+	h.Type("ONE")
+	h.Keys(repltest.ESC)
+	assertRows(t, h, "> ONE two three")
+	assertCursor(t, h, 4, 0)
+
+	// the change and the inserted text are repeated
+	h.Type("w.")
+	assertRows(t, h, "> ONE ONE three")
+	assertCursor(t, h, 8, 0)
+
+	h.Type("u")
+	assertRows(t, h, "> ONE two three")
+}
+
+func TestSetViMode(t *testing.T) {
+	h := start(&echoHandler{}, 30, 5)
+
+	h.Type("ab")
+	assertStatus(t, h, "All")
+
+	h.Repl.SetViMode(true)
+	h.Wait()
+	assertStatus(t, h, "INSERT All")
+
+	h.Keys(repltest.ESC)
+	h.Type("x")
+	assertRows(t, h, "> a")
+
+	// keys are inserted again once the vi mode is disabled
+	h.Repl.SetViMode(false)
+	h.Wait()
+
+	if status := h.StatusBar(); strings.Contains(status, "NORMAL") {
+		t.Errorf("expected no vi mode in the status bar, got %q", status)
+	}
+
+	h.Type("x")
+	assertRows(t, h, "> xa")
+}
@@ -0,0 +1,165 @@
+// Package repltest runs a `repl.Repl` on a virtual terminal, so that tests can type scripted keystrokes and assert on the rendered screen.
+//
+// A typical test:
+//
+//	h := repltest.New(myHandler, 40, 10)
+//	h.Start()
+//	h.Type("add 1 2")
+//	h.Keys(repltest.ENTER)
+//	if h.Screen().Row(1) != "3" { ... }
+package repltest
+
+import (
+	"strings"
+	"time"
+
+	repl "github.com/openengineer/go-repl"
+)
+
+// Keystrokes as sent by a typical terminal emulator (xterm)
+const (
+	ENTER       = "\r"
+	SHIFT_ENTER = "\n"
+	TAB         = "\t"
+	ESC         = "\033"
+	BACKSPACE   = "\x7f"
+	DELETE      = "\033[3~"
+	UP          = "\033[A"
+	DOWN        = "\033[B"
+	RIGHT       = "\033[C"
+	LEFT        = "\033[D"
+	HOME        = "\033[H"
+	END         = "\033[F"
+	CTRL_LEFT   = "\033[1;5D"
+	CTRL_RIGHT  = "\033[1;5C"
+	CTRL_UP     = "\033[1;5A"
+	CTRL_DOWN   = "\033[1;5B"
+	CTRL_A      = "\x01"
+	CTRL_B      = "\x02"
+	CTRL_C      = "\x03"
+	CTRL_D      = "\x04"
+	CTRL_E      = "\x05"
+	CTRL_F      = "\x06"
+	CTRL_K      = "\x0b"
+	CTRL_L      = "\x0c"
+	CTRL_N      = "\x0e"
+	CTRL_P      = "\x10"
+	CTRL_Q      = "\x11"
+	CTRL_R      = "\x12"
+	CTRL_U      = "\x15"
+	CTRL_W      = "\x17"
+	CTRL_Y      = "\x19"
+)
+
+var (
+	// Output is considered complete once the REPL hasn't written anything for this long.
+	SETTLE_INTERVAL = 20 * time.Millisecond
+
+	// Wait gives up after this long, even if the REPL keeps writing.
+	WAIT_TIMEOUT = 2 * time.Second
+)
+
+// Harness drives a Repl running on a virtual Terminal.
+type Harness struct {
+	Repl     *repl.Repl
+	Terminal *Terminal
+
+	done chan error
+}
+
+// Create a Harness with a virtual terminal of the given size. The Repl is accessible before calling Start, so the handler can keep a reference to it.
+func New(handler repl.Handler, width, height int) *Harness {
+	t := NewTerminal(width, height)
+
+	return &Harness{
+		Repl:     repl.NewTerminalRepl(handler, t),
+		Terminal: t,
+		done:     nil,
+	}
+}
+
+// Run the Repl loop in the background and wait for the initial prompt to be drawn.
+func (h *Harness) Start() {
+	h.done = make(chan error, 1)
+
+	go func() {
+		h.done <- h.Repl.Loop()
+	}()
+
+	h.Wait()
+}
+
+// Block until the Repl has stopped writing to the terminal.
+func (h *Harness) Wait() {
+	start := time.Now()
+
+	for {
+		time.Sleep(time.Millisecond)
+
+		now := time.Now()
+		if now.Sub(start) > WAIT_TIMEOUT {
+			return
+		} else if now.Sub(start) >= SETTLE_INTERVAL && now.Sub(h.Terminal.LastWrite()) >= SETTLE_INTERVAL {
+			return
+		}
+	}
+}
+
+// Send each key separately, waiting for the Repl to process it before sending the next one. A key can be a single character, or a complete escape sequence (e.g. UP).
+func (h *Harness) Keys(keys ...string) {
+	for _, key := range keys {
+		h.Terminal.Feed(key)
+
+		// a lone ESC is only recognized after repl.ESCAPE_TIMEOUT
+		if strings.HasSuffix(key, "\033") {
+			time.Sleep(repl.ESCAPE_TIMEOUT)
+		}
+
+		h.Wait()
+	}
+}
+
+// Type the text one character at a time.
+func (h *Harness) Type(text string) {
+	for _, c := range text {
+		h.Keys(string(c))
+	}
+}
+
+// Paste the text all at once, as a terminal emulator would do. The text is surrounded by the bracketed paste sequences if the Repl enabled bracketed paste mode.
+func (h *Harness) Paste(text string) {
+	if h.Screen().Mode("2004") {
+		text = "\033[200~" + text + "\033[201~"
+	}
+
+	h.Keys(text)
+}
+
+// Resize the virtual terminal, and wait for the Repl to redraw.
+func (h *Harness) Resize(width, height int) {
+	h.Terminal.Resize(width, height)
+
+	h.Wait()
+}
+
+// Returns the virtual Screen.
+func (h *Harness) Screen() *Screen {
+	return h.Terminal.Screen
+}
+
+// Returns the 0-based column and row of the cursor.
+func (h *Harness) Cursor() (int, int) {
+	return h.Terminal.Screen.Cursor()
+}
+
+// Returns the text of the bottom row of the screen, with the padding between the left and right fields collapsed to a single space.
+func (h *Harness) StatusBar() string {
+	_, height := h.Terminal.Screen.Size()
+
+	return strings.Join(strings.Fields(h.Terminal.Screen.Row(height-1)), " ")
+}
+
+// Returns a channel that receives the error returned by Loop (e.g. repl.ErrQuit after CTRL_D).
+func (h *Harness) Done() <-chan error {
+	return h.done
+}
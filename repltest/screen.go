@@ -0,0 +1,463 @@
+package repltest
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+type _ParserState int
+
+const (
+	_GROUND _ParserState = iota
+	_ESCAPE
+	_CSI
+	_OSC
+	_OSC_ESCAPE
+)
+
+// Cell is a single column of the virtual Screen.
+type Cell struct {
+	Text  string // a single grapheme cluster, or empty if the cell is covered by the wide character in the previous cell
+	Style string // SGR parameters in effect when the text was written (e.g. "48;5;247;30"), empty for default style
+}
+
+// Screen is a virtual terminal screen. Bytes written to it are interpreted as text and ANSI escape sequences, and the result is kept in a grid of cells.
+//
+// Only the subset of escape sequences needed by go-repl is interpreted, other sequences are ignored.
+type Screen struct {
+	lock *sync.Mutex
+
+	width  int
+	height int
+	cells  [][]Cell
+
+	x           int
+	y           int
+	wrapPending bool   // the last column was written, the next printable character moves to the next row
+	style       string // current SGR parameters
+
+	state _ParserState
+	seq   []byte // collected bytes of the current escape sequence
+	pend  []byte // incomplete utf-8 sequence
+	modes map[string]bool
+	onDSR func(x, y int) // called when the cursor position is queried
+}
+
+// Create a new blank Screen of the given size, with the cursor in the top left corner.
+func NewScreen(width, height int) *Screen {
+	s := &Screen{
+		lock:        &sync.Mutex{},
+		width:       width,
+		height:      height,
+		cells:       nil,
+		x:           0,
+		y:           0,
+		wrapPending: false,
+		style:       "",
+		state:       _GROUND,
+		seq:         make([]byte, 0),
+		pend:        make([]byte, 0),
+		modes:       make(map[string]bool),
+		onDSR:       nil,
+	}
+
+	s.cells = make([][]Cell, height)
+	for i := range s.cells {
+		s.cells[i] = blankRow(width)
+	}
+
+	return s
+}
+
+func blankRow(w int) []Cell {
+	row := make([]Cell, w)
+
+	for i := range row {
+		row[i] = Cell{" ", ""}
+	}
+
+	return row
+}
+
+// Interpret the bytes. Never returns an error.
+func (s *Screen) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, b := range p {
+		s.writeByte(b)
+	}
+
+	return len(p), nil
+}
+
+func (s *Screen) writeByte(b byte) {
+	switch s.state {
+	case _ESCAPE:
+		switch b {
+		case '[':
+			s.state = _CSI
+			s.seq = s.seq[:0]
+		case ']':
+			s.state = _OSC
+		default:
+			// two byte escape sequences are ignored
+			s.state = _GROUND
+		}
+	case _CSI:
+		if b >= 0x40 && b <= 0x7e {
+			s.state = _GROUND
+			s.execCSI(string(s.seq), b)
+		} else {
+			s.seq = append(s.seq, b)
+		}
+	case _OSC:
+		if b == 7 {
+			s.state = _GROUND
+		} else if b == 27 {
+			s.state = _OSC_ESCAPE
+		}
+	case _OSC_ESCAPE:
+		s.state = _GROUND
+	default:
+		if len(s.pend) > 0 || b >= 0x80 {
+			s.pend = append(s.pend, b)
+
+			if utf8.FullRune(s.pend) {
+				c, _ := utf8.DecodeRune(s.pend)
+				s.pend = s.pend[:0]
+				s.put(string(c))
+			}
+
+			return
+		}
+
+		switch b {
+		case 27:
+			s.state = _ESCAPE
+		case '\r':
+			s.x = 0
+			s.wrapPending = false
+		case '\n':
+			s.lineFeed()
+		case '\b':
+			if s.x > 0 {
+				s.x -= 1
+			}
+			s.wrapPending = false
+		case '\t':
+			s.x = (s.x/8 + 1) * 8
+			if s.x >= s.width {
+				s.x = s.width - 1
+			}
+		case 7:
+			// bell
+		default:
+			if b >= 32 && b != 127 {
+				s.put(string(rune(b)))
+			}
+		}
+	}
+}
+
+func (s *Screen) lineFeed() {
+	s.wrapPending = false
+
+	if s.height == 0 {
+		return
+	} else if s.y == s.height-1 {
+		s.scrollUp()
+	} else {
+		s.y += 1
+	}
+}
+
+func (s *Screen) scrollUp() {
+	copy(s.cells, s.cells[1:])
+
+	s.cells[s.height-1] = blankRow(s.width)
+}
+
+// the cell containing the last written character
+func (s *Screen) prevCell() *Cell {
+	x := s.x
+	if !s.wrapPending {
+		x -= 1
+	}
+
+	for x >= 0 && s.cells[s.y][x].Text == "" {
+		x -= 1
+	}
+
+	if x < 0 {
+		return nil
+	}
+
+	return &s.cells[s.y][x]
+}
+
+func (s *Screen) put(c string) {
+	if s.width == 0 || s.height == 0 {
+		return
+	}
+
+	cw := uniseg.StringWidth(c)
+
+	// zero-width characters (e.g. combining accents) and characters following a zero-width joiner are added to the previous cell
+	if prev := s.prevCell(); prev != nil && (cw == 0 || strings.HasSuffix(prev.Text, "\u200d")) {
+		prev.Text += c
+		return
+	} else if cw == 0 {
+		return
+	} else if cw > s.width {
+		// a wide character doesn't fit on a screen that is narrower than the character, terminals discard it
+		return
+	}
+
+	if s.wrapPending || s.x+cw > s.width {
+		s.x = 0
+		s.lineFeed()
+	}
+
+	s.cells[s.y][s.x] = Cell{c, s.style}
+
+	for i := 1; i < cw; i++ {
+		s.cells[s.y][s.x+i] = Cell{"", s.style}
+	}
+
+	if s.x+cw >= s.width {
+		s.x = s.width - 1
+		s.wrapPending = true
+	} else {
+		s.x += cw
+	}
+}
+
+// params with missing or zero values are replaced by the default
+func parseParams(seq string, n int, def int) []int {
+	res := make([]int, n)
+
+	parts := strings.Split(seq, ";")
+
+	for i := range res {
+		res[i] = def
+
+		if i < len(parts) {
+			v, err := strconv.Atoi(parts[i])
+			if err == nil && v != 0 {
+				res[i] = v
+			}
+		}
+	}
+
+	return res
+}
+
+func (s *Screen) execCSI(seq string, final byte) {
+	if strings.HasPrefix(seq, "?") {
+		switch final {
+		case 'h':
+			s.modes[seq[1:]] = true
+		case 'l':
+			s.modes[seq[1:]] = false
+		}
+
+		return
+	}
+
+	s.wrapPending = false
+
+	switch final {
+	case 'A':
+		s.y -= parseParams(seq, 1, 1)[0]
+	case 'B':
+		s.y += parseParams(seq, 1, 1)[0]
+	case 'C':
+		s.x += parseParams(seq, 1, 1)[0]
+	case 'D':
+		s.x -= parseParams(seq, 1, 1)[0]
+	case 'E':
+		s.y += parseParams(seq, 1, 1)[0]
+		s.x = 0
+	case 'F':
+		s.y -= parseParams(seq, 1, 1)[0]
+		s.x = 0
+	case 'G':
+		s.x = parseParams(seq, 1, 1)[0] - 1
+	case 'H', 'f':
+		ps := parseParams(seq, 2, 1)
+		s.y = ps[0] - 1
+		s.x = ps[1] - 1
+	case 'J':
+		s.eraseDisplay(parseParams(seq, 1, 0)[0])
+	case 'K':
+		s.eraseLine(parseParams(seq, 1, 0)[0])
+	case 'm':
+		if seq == "" || seq == "0" {
+			s.style = ""
+		} else if s.style == "" {
+			s.style = seq
+		} else {
+			s.style = s.style + ";" + seq
+		}
+	case 'n':
+		if seq == "6" && s.onDSR != nil {
+			s.onDSR(s.x, s.y)
+		}
+	}
+
+	s.clampCursor()
+}
+
+func (s *Screen) clampCursor() {
+	if s.x < 0 {
+		s.x = 0
+	} else if s.x >= s.width {
+		s.x = s.width - 1
+	}
+
+	if s.y < 0 {
+		s.y = 0
+	} else if s.y >= s.height {
+		s.y = s.height - 1
+	}
+}
+
+func (s *Screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.eraseLine(0)
+		for y := s.y + 1; y < s.height; y++ {
+			s.cells[y] = blankRow(s.width)
+		}
+	case 1:
+		s.eraseLine(1)
+		for y := 0; y < s.y; y++ {
+			s.cells[y] = blankRow(s.width)
+		}
+	default:
+		for y := range s.cells {
+			s.cells[y] = blankRow(s.width)
+		}
+	}
+}
+
+func (s *Screen) eraseLine(mode int) {
+	if s.y < 0 || s.y >= s.height {
+		return
+	}
+
+	row := s.cells[s.y]
+
+	start, stop := 0, s.width
+	switch mode {
+	case 0:
+		start = s.x
+	case 1:
+		stop = s.x + 1
+	}
+
+	for x := start; x < stop && x < s.width; x++ {
+		row[x] = Cell{" ", ""}
+	}
+}
+
+// Change the size of the screen. Rows and columns are cut off or added at the bottom and on the right, text isn't reflowed.
+func (s *Screen) Resize(width, height int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cells := make([][]Cell, height)
+	for y := range cells {
+		cells[y] = blankRow(width)
+
+		if y < s.height {
+			copy(cells[y], s.cells[y])
+		}
+	}
+
+	s.width, s.height = width, height
+	s.cells = cells
+	s.wrapPending = false
+
+	s.clampCursor()
+}
+
+// Returns the width and height of the screen.
+func (s *Screen) Size() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.width, s.height
+}
+
+// Returns the 0-based column and row of the cursor.
+func (s *Screen) Cursor() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.x, s.y
+}
+
+// Returns the text of row y, without trailing spaces.
+func (s *Screen) Row(y int) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.row(y)
+}
+
+func (s *Screen) row(y int) string {
+	if y < 0 || y >= s.height {
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, c := range s.cells[y] {
+		sb.WriteString(c.Text)
+	}
+
+	return strings.TrimRight(sb.String(), " ")
+}
+
+// Returns the text of all the rows, without trailing spaces.
+func (s *Screen) Rows() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rows := make([]string, s.height)
+	for y := range rows {
+		rows[y] = s.row(y)
+	}
+
+	return rows
+}
+
+// Returns the cell at column x and row y.
+func (s *Screen) CellAt(x, y int) Cell {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if y < 0 || y >= s.height || x < 0 || x >= s.width {
+		return Cell{" ", ""}
+	}
+
+	return s.cells[y][x]
+}
+
+// Returns true if a private mode (e.g. "2004" for bracketed paste) was enabled with `CSI ? <mode> h`.
+func (s *Screen) Mode(mode string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.modes[mode]
+}
+
+// Returns all the rows joined by newlines, with trailing empty rows removed.
+func (s *Screen) String() string {
+	return strings.TrimRight(strings.Join(s.Rows(), "\n"), "\n")
+}
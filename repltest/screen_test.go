@@ -0,0 +1,287 @@
+package repltest
+
+import (
+	"io"
+	"testing"
+)
+
+func newScreen(width, height int, output string) *Screen {
+	s := NewScreen(width, height)
+
+	io.WriteString(s, output)
+
+	return s
+}
+
+func assertRows(t *testing.T, s *Screen, rows ...string) {
+	t.Helper()
+
+	for y, row := range rows {
+		if got := s.Row(y); got != row {
+			t.Errorf("row %d: expected %q, got %q\n%s", y, row, got, s)
+		}
+	}
+}
+
+func assertCursor(t *testing.T, s *Screen, x, y int) {
+	t.Helper()
+
+	if gotX, gotY := s.Cursor(); gotX != x || gotY != y {
+		t.Errorf("expected cursor at %d,%d, got %d,%d", x, y, gotX, gotY)
+	}
+}
+
+func TestScreenText(t *testing.T) {
+	s := newScreen(10, 3, "abc\r\ndef")
+
+	assertRows(t, s, "abc", "def", "")
+	assertCursor(t, s, 3, 1)
+
+	// a line feed doesn't return the cursor to the first column
+	io.WriteString(s, "\ngh")
+	assertRows(t, s, "abc", "def", "   gh")
+}
+
+func TestScreenWrap(t *testing.T) {
+	s := newScreen(5, 3, "abcde")
+
+	// the cursor stays on the last column until the next character is written
+	assertRows(t, s, "abcde", "")
+	assertCursor(t, s, 4, 0)
+
+	io.WriteString(s, "f")
+	assertRows(t, s, "abcde", "f")
+	assertCursor(t, s, 1, 1)
+
+	// a carriage return cancels the pending wrap
+	s = newScreen(5, 3, "abcde\rx")
+	assertRows(t, s, "xbcde", "")
+}
+
+func TestScreenScroll(t *testing.T) {
+	s := newScreen(5, 3, "a\r\nb\r\nc\r\nd")
+
+	assertRows(t, s, "b", "c", "d")
+	assertCursor(t, s, 1, 2)
+
+	s = newScreen(5, 2, "abcdefghijk")
+	assertRows(t, s, "fghij", "k")
+}
+
+func TestScreenCursorMovement(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		x      int
+		y      int
+	}{
+		{"position", "\033[3;4H", 3, 2},
+		{"position defaults", "\033[3;4H\033[H", 0, 0},
+		{"position clamped", "\033[99;99H", 9, 4},
+		{"up", "\033[4;4H\033[2A", 3, 1},
+		{"up clamped", "\033[9A", 0, 0},
+		{"down", "\033[B", 0, 1},
+		{"right", "\033[5C", 5, 0},
+		{"right clamped", "\033[20C", 9, 0},
+		{"left", "abcd\033[2D", 2, 0},
+		{"next line", "abc\033[2E", 0, 2},
+		{"previous line", "\033[4;4H\033[F", 0, 2},
+		{"column", "\033[2;1H\033[7G", 6, 1},
+		{"backspace", "ab\b", 1, 0},
+		{"tab", "a\t", 8, 0},
+	}
+
+	for _, test := range tests {
+		s := newScreen(10, 5, test.output)
+
+		if x, y := s.Cursor(); x != test.x || y != test.y {
+			t.Errorf("%s: expected cursor at %d,%d, got %d,%d", test.name, test.x, test.y, x, y)
+		}
+	}
+}
+
+func TestScreenErase(t *testing.T) {
+	const fill = "abcde\r\nfghij\r\nklmno\033[2;3H"
+
+	tests := []struct {
+		name   string
+		output string
+		rows   []string
+	}{
+		{"line after cursor", fill + "\033[K", []string{"abcde", "fg", "klmno"}},
+		{"line before cursor", fill + "\033[1K", []string{"abcde", "   ij", "klmno"}},
+		{"whole line", fill + "\033[2K", []string{"abcde", "", "klmno"}},
+		{"screen after cursor", fill + "\033[J", []string{"abcde", "fg", ""}},
+		{"screen before cursor", fill + "\033[1J", []string{"", "   ij", "klmno"}},
+		{"whole screen", fill + "\033[2J", []string{"", "", ""}},
+	}
+
+	for _, test := range tests {
+		s := newScreen(5, 3, test.output)
+
+		for y, row := range test.rows {
+			if got := s.Row(y); got != row {
+				t.Errorf("%s: row %d: expected %q, got %q", test.name, y, row, got)
+			}
+		}
+
+		// erasing doesn't move the cursor
+		if x, y := s.Cursor(); x != 2 || y != 1 {
+			t.Errorf("%s: expected cursor at 2,1, got %d,%d", test.name, x, y)
+		}
+	}
+}
+
+func TestScreenStyle(t *testing.T) {
+	s := newScreen(10, 1, "a\033[1mb\033[90mc\033[0md\033[7me\033[mf")
+
+	expected := []string{"", "1", "1;90", "", "7", ""}
+
+	for x, style := range expected {
+		if got := s.CellAt(x, 0).Style; got != style {
+			t.Errorf("column %d: expected style %q, got %q", x, style, got)
+		}
+	}
+
+	// erased cells don't keep the style
+	io.WriteString(s, "\033[1m\033[2K")
+
+	if got := s.CellAt(0, 0); got != (Cell{" ", ""}) {
+		t.Errorf("expected a blank cell, got %v", got)
+	}
+}
+
+func TestScreenWideCharacters(t *testing.T) {
+	s := newScreen(5, 2, "a世b")
+
+	assertRows(t, s, "a世b")
+	assertCursor(t, s, 4, 0)
+
+	if got := s.CellAt(2, 0).Text; got != "" {
+		t.Errorf("expected the second column of the wide character to be empty, got %q", got)
+	}
+
+	// a wide character that doesn't fit on the last column wraps
+	io.WriteString(s, "界")
+	assertRows(t, s, "a世b", "界")
+	assertCursor(t, s, 2, 1)
+
+	// a wide character never fits on a screen with a single column
+	s = newScreen(1, 2, "世a")
+	assertRows(t, s, "a", "")
+}
+
+func TestScreenGraphemeClusters(t *testing.T) {
+	// combining accent, and a family emoji joined by zero-width joiners
+	s := newScreen(10, 1, "éx\U0001F468‍\U0001F469‍\U0001F467y")
+
+	if got := s.CellAt(0, 0).Text; got != "é" {
+		t.Errorf("expected combined accent, got %q", got)
+	}
+
+	if got := s.CellAt(2, 0).Text; got != "\U0001F468‍\U0001F469‍\U0001F467" {
+		t.Errorf("expected joined emoji, got %q", got)
+	}
+
+	if got := s.CellAt(4, 0).Text; got != "y" {
+		t.Errorf("expected y after the wide emoji, got %q", got)
+	}
+}
+
+func TestScreenSplitUTF8(t *testing.T) {
+	s := NewScreen(5, 1)
+
+	s.Write([]byte{0xe4, 0xb8})
+	s.Write([]byte{0x96})
+
+	assertRows(t, s, "世")
+}
+
+func TestScreenIgnoredSequences(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{"osc terminated by bel", "\033]0;title\007"},
+		{"osc terminated by st", "\033]0;title\033\\"},
+		{"two byte escape", "\0337"},
+		{"bell", "\007"},
+		{"unsupported csi", "\033[5n"},
+	}
+
+	for _, test := range tests {
+		s := newScreen(10, 1, "a"+test.output+"b")
+
+		if got := s.Row(0); got != "ab" {
+			t.Errorf("%s: expected %q, got %q", test.name, "ab", got)
+		}
+	}
+}
+
+func TestScreenModes(t *testing.T) {
+	s := newScreen(10, 1, "\033[?2004h")
+
+	if !s.Mode("2004") {
+		t.Errorf("expected bracketed paste mode")
+	}
+
+	io.WriteString(s, "\033[?2004l")
+
+	if s.Mode("2004") {
+		t.Errorf("expected bracketed paste mode to be disabled")
+	}
+}
+
+func TestScreenResize(t *testing.T) {
+	s := newScreen(5, 3, "abcde\r\nfghij\033[3;5H")
+
+	s.Resize(3, 2)
+
+	assertRows(t, s, "abc", "fgh")
+	assertCursor(t, s, 2, 1)
+
+	s.Resize(6, 3)
+
+	assertRows(t, s, "abc", "fgh", "")
+
+	// nothing is drawn on an empty screen
+	s.Resize(0, 0)
+
+	io.WriteString(s, "abc世\r\n\033[K\033[2J")
+
+	if rows := s.Rows(); len(rows) != 0 {
+		t.Errorf("expected no rows, got %q", rows)
+	}
+}
+
+func TestTerminalCursorQuery(t *testing.T) {
+	term := NewTerminal(10, 5)
+
+	io.WriteString(term, "\033[3;7H\033[6n")
+
+	buf := make([]byte, 16)
+	n, err := term.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(buf[0:n]); got != "\033[3;7R" {
+		t.Errorf("expected cursor position report, got %q", got)
+	}
+}
+
+func TestTerminalHoldCursorReports(t *testing.T) {
+	term := NewTerminal(10, 5)
+
+	term.HoldCursorReports(true)
+	io.WriteString(term, "\033[6n")
+	term.Feed("a")
+
+	// the held report is sent after the input that was fed in the meantime
+	term.HoldCursorReports(false)
+	term.Close()
+
+	if got, _ := io.ReadAll(term); string(got) != "a\033[1;1R" {
+		t.Errorf("expected the held report after the input, got %q", got)
+	}
+}
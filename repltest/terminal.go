@@ -0,0 +1,191 @@
+package repltest
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Terminal is an in-memory implementation of `repl.Terminal`. The output of the REPL is rendered on a virtual Screen, and the input is fed by the test.
+//
+// Cursor position queries are answered automatically, like a real terminal emulator would, unless the answers are held (see HoldCursorReports).
+type Terminal struct {
+	Screen *Screen
+
+	lock      *sync.Mutex
+	cond      *sync.Cond
+	input     []byte
+	closed    bool
+	raw       bool
+	lastWrite time.Time
+	hold      bool     // cursor position reports are held
+	held      []string // reports that weren't sent yet
+
+	sizeChanges chan struct{}
+}
+
+// Create a new Terminal with a blank Screen of the given size.
+func NewTerminal(width, height int) *Terminal {
+	lock := &sync.Mutex{}
+
+	t := &Terminal{
+		Screen:    NewScreen(width, height),
+		lock:      lock,
+		cond:      sync.NewCond(lock),
+		input:     make([]byte, 0),
+		closed:    false,
+		raw:       false,
+		lastWrite: time.Now(),
+		hold:      false,
+		held:      make([]string, 0),
+
+		sizeChanges: make(chan struct{}, 1),
+	}
+
+	t.Screen.onDSR = func(x, y int) {
+		t.report(fmt.Sprintf("\033[%d;%dR", y+1, x+1))
+	}
+
+	return t
+}
+
+// Blocks until some input is available, returns io.EOF after Close.
+func (t *Terminal) Read(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for len(t.input) == 0 && !t.closed {
+		t.cond.Wait()
+	}
+
+	if len(t.input) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, t.input)
+	t.input = t.input[n:]
+
+	return n, nil
+}
+
+func (t *Terminal) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	t.lastWrite = time.Now()
+	t.lock.Unlock()
+
+	return t.Screen.Write(p)
+}
+
+// Always returns true, the virtual terminal is interactive.
+func (t *Terminal) IsTerminal() bool {
+	return true
+}
+
+func (t *Terminal) GetSize() (int, int, error) {
+	w, h := t.Screen.Size()
+
+	return w, h, nil
+}
+
+// Implements repl.ResizeNotifier, a value is sent after every call to Resize.
+func (t *Terminal) SizeChanges() <-chan struct{} {
+	return t.sizeChanges
+}
+
+// Change the size of the Screen and notify the REPL.
+func (t *Terminal) Resize(width, height int) {
+	t.Screen.Resize(width, height)
+
+	select {
+	case t.sizeChanges <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Terminal) MakeRaw() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.raw = true
+
+	return nil
+}
+
+func (t *Terminal) Restore() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.raw = false
+
+	return nil
+}
+
+// Returns true if the terminal is currently in raw mode.
+func (t *Terminal) IsRaw() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.raw
+}
+
+// Make the bytes available for reading, as if they were typed by the user.
+func (t *Terminal) Feed(s string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.feed(s)
+}
+
+func (t *Terminal) feed(s string) {
+	t.input = append(t.input, []byte(s)...)
+
+	t.cond.Broadcast()
+}
+
+func (t *Terminal) report(s string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.hold {
+		t.held = append(t.held, s)
+	} else {
+		t.feed(s)
+	}
+}
+
+// Hold the answers to cursor position queries, to test what the REPL does while it waits for an answer. The held answers are sent once this is called with false.
+func (t *Terminal) HoldCursorReports(hold bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.hold = hold
+
+	if !hold {
+		for _, s := range t.held {
+			t.feed(s)
+		}
+
+		t.held = t.held[:0]
+	}
+}
+
+// Signal the end of the input, any pending Read returns io.EOF once the remaining input has been consumed.
+func (t *Terminal) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+
+	t.cond.Broadcast()
+
+	return nil
+}
+
+// Returns the time of the last write by the REPL.
+func (t *Terminal) LastWrite() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.lastWrite
+}
@@ -1,91 +1,85 @@
 package repl
 
 import (
-	"bufio"
-	"os"
+	"io"
 	"sync"
 	"time"
 )
 
-// This is a cut-off time for grouping auto-generated escape sequences.
+// Deprecated: input is no longer grouped by timing, escape sequences are decoded by a state machine instead (see ESCAPE_TIMEOUT).
 const MACHINE_INTERVAL = time.Millisecond
 
-// _StdinReader collects inputs and keeps sequences of auto-generated bytes together as a group (eg. ansi escape sequences)
+// _StdinReader reads chunks of input in a separate goroutine, but only on request, so the input isn't stolen from interactive subprocesses run by the Handler.
+// A chunk can contain several keystrokes, or only part of an escape sequence, the chunks are decoded by a _KeyParser.
 type _StdinReader struct {
-	reader   *bufio.Reader
-	lastTime time.Time
-	buffer   []byte
-	lock     *sync.Mutex
+	in          io.Reader
+	outstanding bool // a chunk has been requested but not yet read
+	lock        *sync.Mutex
 
-	bytes chan []byte
+	requests chan struct{}
+	bytes    chan []byte
+	errs     chan error // receives the error that stopped the reading
 }
 
-func newStdinReader() *_StdinReader {
+func newStdinReader(in io.Reader) *_StdinReader {
 	return &_StdinReader{
-		reader:   nil,
-		lastTime: time.Time{},
-		buffer:   make([]byte, 0),
-		lock:     &sync.Mutex{},
+		in:          in,
+		outstanding: false,
+		lock:        &sync.Mutex{},
 
-		bytes: make(chan []byte),
+		requests: make(chan struct{}, 1),
+		bytes:    make(chan []byte),
+		errs:     make(chan error, 1),
 	}
 }
 
-func (r *_StdinReader) start() {
+// stops when done is closed
+func (r *_StdinReader) start(done <-chan struct{}) {
 	go func() {
+		buf := make([]byte, 4096)
+
 		for {
-			<-time.After(MACHINE_INTERVAL)
+			select {
+			case <-r.requests:
+			case <-done:
+				return
+			}
 
-			r.lock.Lock()
+			n, err := r.in.Read(buf)
 
-			if len(r.buffer) > 0 {
-				if time.Now().After(r.lastTime.Add(MACHINE_INTERVAL)) {
-					msg := r.buffer
+			r.lock.Lock()
+			r.outstanding = false
+			r.lock.Unlock()
 
-					r.buffer = make([]byte, 0)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[0:n])
 
-					r.bytes <- msg
+				select {
+				case r.bytes <- chunk:
+				case <-done:
+					return
 				}
 			}
 
-			r.lock.Unlock()
+			if err != nil {
+				// no more chunks are read
+				r.errs <- err
+				return
+			}
 		}
 	}()
 }
 
+// request the next chunk, unless it is already requested
 func (r *_StdinReader) read() {
-	if r.reader != nil {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.outstanding {
 		return
 	}
 
-	r.reader = bufio.NewReader(os.Stdin)
-	r.lastTime = time.Now()
-
-	go func() {
-		for {
-			b, err := r.reader.ReadByte()
-			if err != nil {
-				panic(err)
-			}
-
-			stopNow := false
-			if b == 13 && time.Now().After(r.lastTime.Add(MACHINE_INTERVAL)) {
-				// it is unlikely that a carriage return followed by some text is pasted into the terminal, so we can use this as a queu to quit
-				stopNow = true
-			}
-
-			r.lastTime = time.Now()
-
-			r.lock.Lock()
-
-			r.buffer = append(r.buffer, b)
-
-			r.lock.Unlock()
-
-			if stopNow {
-				r.reader = nil
-				return
-			}
-		}
-	}()
+	r.outstanding = true
+	r.requests <- struct{}{}
 }
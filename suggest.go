@@ -0,0 +1,106 @@
+package repl
+
+import (
+	"bytes"
+	"strings"
+)
+
+var (
+	// SGR parameters of the suggestion that is shown after the cursor, "90" is grey in most color schemes.
+	SUGGESTION_STYLE = "90"
+)
+
+// the text that would complete the buffer, suggested by the Hinter or else by the most recent matching history entry
+func (r *Repl) suggestion() string {
+	if r.bufferLen() == 0 || r.bufferPos != r.bufferLen() || r.searchActive() || r.menuActive() || r.pickerActive() || (r.vi != nil && r.vi.normal) {
+		return ""
+	}
+
+	if h, ok := r.handler.(Hinter); ok {
+		return h.Hint(string(r.buffer))
+	}
+
+	for i := len(r.history) - 1; i >= 0; i-- {
+		entry := r.history[i]
+
+		if len(entry) > r.bufferLen() && bytes.HasPrefix(entry, r.buffer) {
+			return string(entry[r.bufferLen():])
+		}
+	}
+
+	return ""
+}
+
+// the suggestion is only drawn on the row of the cursor, after the end of the buffer
+func (r *Repl) drawSuggestion() {
+	if r.queried || r.evaluating || r.overflow() {
+		return
+	}
+
+	suggestion := r.suggestion()
+	if suggestion == "" && !r.suggested {
+		return
+	}
+
+	x, y := r.cursorCoord(r.bufferLen())
+
+	moveCursorTo(r.term, x, y)
+	clearRowAfterCursor(r.term)
+
+	r.suggested = false
+
+	if suggestion != "" {
+		line := strings.SplitN(suggestion, "\n", 2)[0]
+
+		line = truncateToWidth(string(cleanInput([]byte(line))), r.getWidth()-x)
+
+		if line != "" {
+			setStyle(r.term, SUGGESTION_STYLE)
+			r.term.Write([]byte(line))
+			resetDecorations(r.term)
+
+			r.suggested = true
+		}
+	}
+
+	if r.searchActive() || r.pickerActive() {
+		// the cursor belongs in the status bar
+		r.clearStatus()
+		r.writeStatus()
+	} else {
+		r.syncCursor()
+	}
+}
+
+func (r *Repl) clearSuggestion() {
+	if r.suggested && !r.overflow() {
+		r.suggested = false
+
+		r.syncCursorTo(r.bufferLen())
+		clearRowAfterCursor(r.term)
+		r.syncCursor()
+	}
+}
+
+// insert the suggestion, or only its first word, returns false if there is no suggestion
+func (r *Repl) acceptSuggestion(word bool) bool {
+	suggestion := r.suggestion()
+	if suggestion == "" {
+		return false
+	}
+
+	if word {
+		full := append(copyBytes(r.buffer), suggestion...)
+
+		suggestion = suggestion[0 : r.phrasePosAfter(full, r.bufferLen())-r.bufferLen()]
+	}
+
+	lines := strings.Split(suggestion, "\n")
+	for i, line := range lines {
+		lines[i] = string(cleanInput([]byte(line)))
+	}
+
+	r.addBytesToBuffer([]byte(strings.Join(lines, "\n")))
+
+	return true
+}
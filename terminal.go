@@ -0,0 +1,103 @@
+package repl
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// Terminal is the connection between a `Repl` and the terminal emulator of the user.
+//
+// Implement this interface in order to run a `Repl` over something other than the stdin/stdout of the current process (e.g. a pty, a network connection or an in-memory fake).
+type Terminal interface {
+	// keystrokes and replies to escape sequence queries are read from here
+	io.Reader
+
+	// the REPL output, including the ANSI escape sequences, is written here
+	io.Writer
+
+	// returns false if the input isn't an interactive terminal (e.g. a file or a pipe), in which case the REPL reads plain lines of input
+	IsTerminal() bool
+
+	// returns width and height (number of columns and rows) of the terminal
+	GetSize() (int, int, error)
+
+	// put the terminal in raw mode, so the REPL can intercept the control sequences
+	MakeRaw() error
+
+	// restore the terminal state from before the last call to MakeRaw
+	Restore() error
+}
+
+// Optionally implement this interface in a custom Terminal that is able to signal size changes (e.g. an ssh channel that receives window-change requests).
+// The REPL polls the size every SIZE_POLLING_INTERVAL for Terminals that don't implement this interface.
+type ResizeNotifier interface {
+	// returns a channel that receives a value whenever the size of the terminal might have changed, or nil if size changes can't be signalled
+	SizeChanges() <-chan struct{}
+}
+
+// implemented by Terminals that must release the resources used for signalling size changes once the REPL quits
+type _SizeChangesStopper interface {
+	stopSizeChanges()
+}
+
+// _StdTerminal uses the stdin and stdout of the current process
+type _StdTerminal struct {
+	in          *os.File
+	out         *os.File
+	oldState    *term.State
+	sizeSignals chan os.Signal // nil unless SIGWINCH is subscribed
+	sizeChanges chan struct{}
+}
+
+// Create a Terminal that uses the stdin and stdout of the current process. This is the terminal used by `NewRepl`.
+func NewStdTerminal() Terminal {
+	return &_StdTerminal{
+		in:          os.Stdin,
+		out:         os.Stdout,
+		oldState:    nil,
+		sizeSignals: nil,
+		sizeChanges: nil,
+	}
+}
+
+func (t *_StdTerminal) Read(p []byte) (int, error) {
+	return t.in.Read(p)
+}
+
+func (t *_StdTerminal) Write(p []byte) (int, error) {
+	return t.out.Write(p)
+}
+
+func (t *_StdTerminal) IsTerminal() bool {
+	return term.IsTerminal(int(t.in.Fd()))
+}
+
+func (t *_StdTerminal) GetSize() (int, int, error) {
+	return term.GetSize(int(t.in.Fd()))
+}
+
+func (t *_StdTerminal) MakeRaw() error {
+	// we need the term package as a platform independent way of setting the connected terminal emulator to raw mode
+	oldState, err := term.MakeRaw(int(t.in.Fd()))
+	if err != nil {
+		return err
+	}
+
+	t.oldState = oldState
+
+	return nil
+}
+
+func (t *_StdTerminal) Restore() error {
+	if t.oldState == nil {
+		return nil
+	}
+
+	oldState := t.oldState
+
+	t.oldState = nil
+
+	return term.Restore(int(t.in.Fd()), oldState)
+}
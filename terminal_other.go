@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package repl
+
+// size changes aren't signalled, so the REPL falls back to polling
+func (t *_StdTerminal) SizeChanges() <-chan struct{} {
+	return nil
+}
+
+func (t *_StdTerminal) stopSizeChanges() {
+}
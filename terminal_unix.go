@@ -0,0 +1,49 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package repl
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// the kernel sends SIGWINCH to the process when the size of its controlling terminal changes
+func (t *_StdTerminal) SizeChanges() <-chan struct{} {
+	if t.sizeChanges == nil {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGWINCH)
+
+		sizeChanges := make(chan struct{}, 1)
+
+		t.sizeSignals = sig
+		t.sizeChanges = sizeChanges
+
+		go func() {
+			for range sig {
+				select {
+				case sizeChanges <- struct{}{}:
+				default:
+					// a size change is already pending
+				}
+			}
+		}()
+	}
+
+	return t.sizeChanges
+}
+
+// the forwarding goroutine ends once the signal channel is closed
+func (t *_StdTerminal) stopSizeChanges() {
+	if t.sizeSignals == nil {
+		return
+	}
+
+	// no more signals are delivered to the channel once Stop returns, so it can be closed safely
+	signal.Stop(t.sizeSignals)
+	close(t.sizeSignals)
+
+	t.sizeSignals = nil
+	t.sizeChanges = nil
+}
@@ -0,0 +1,113 @@
+package repl
+
+import (
+	"bytes"
+)
+
+// snapshot of the buffer before an edit
+type _UndoEntry struct {
+	buffer []byte
+	pos    int
+}
+
+// actions that aren't edits themselves
+var undoExempt = map[string]bool{
+	"undo":            true,
+	"redo":            true,
+	"evalBuffer":      true,
+	"forceEvalBuffer": true,
+}
+
+func (r *Repl) pushUndo(buffer []byte, pos int) {
+	n := len(r.undoStack)
+	if n > 0 && bytes.Equal(r.undoStack[n-1].buffer, buffer) {
+		r.undoStack[n-1].pos = pos
+		return
+	}
+
+	r.undoStack = append(r.undoStack, _UndoEntry{buffer, pos})
+}
+
+// take a snapshot before an edit, a new edit can't be redone
+func (r *Repl) saveUndo() {
+	r.pushUndo(copyBytes(r.buffer), r.bufferPos)
+
+	r.redoStack = r.redoStack[:0]
+	r.undoGroup = ""
+}
+
+// run fn, and make its changes to the buffer undoable
+// consecutive edits of the same non-empty group (e.g. typed characters) are undone at once
+func (r *Repl) undoable(group string, fn func()) {
+	if r.vi != nil && !r.vi.normal {
+		// a vi insert session is undone at once, see execVi
+		fn()
+		return
+	}
+
+	before, pos := copyBytes(r.buffer), r.bufferPos
+
+	fn()
+
+	if bytes.Equal(before, r.buffer) {
+		if group != r.undoGroup {
+			// e.g. cursor movements separate the typed words
+			r.undoGroup = ""
+		}
+
+		return
+	}
+
+	if group == "" || group != r.undoGroup {
+		r.pushUndo(before, pos)
+	}
+
+	r.redoStack = r.redoStack[:0]
+	r.undoGroup = group
+}
+
+// restore the most recent snapshot that differs from the current buffer, returns false if there is nothing to undo
+func (r *Repl) undo() bool {
+	r.undoGroup = ""
+
+	for len(r.undoStack) > 0 {
+		n := len(r.undoStack)
+		entry := r.undoStack[n-1]
+		r.undoStack = r.undoStack[0 : n-1]
+
+		if !bytes.Equal(entry.buffer, r.buffer) {
+			r.redoStack = append(r.redoStack, _UndoEntry{copyBytes(r.buffer), r.bufferPos})
+
+			r.force(entry.buffer, entry.pos)
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns false if there is nothing to redo
+func (r *Repl) redo() bool {
+	r.undoGroup = ""
+
+	n := len(r.redoStack)
+	if n == 0 {
+		return false
+	}
+
+	entry := r.redoStack[n-1]
+	r.redoStack = r.redoStack[0 : n-1]
+
+	r.pushUndo(copyBytes(r.buffer), r.bufferPos)
+
+	r.force(entry.buffer, entry.pos)
+
+	return true
+}
+
+// undo is per line
+func (r *Repl) resetUndo() {
+	r.undoStack = make([]_UndoEntry, 0)
+	r.redoStack = make([]_UndoEntry, 0)
+	r.undoGroup = ""
+}
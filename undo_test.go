@@ -0,0 +1,93 @@
+package repl_test
+
+import (
+	"testing"
+
+	"github.com/openengineer/go-repl/repltest"
+)
+
+const (
+	UNDO = "\x1f"  // CTRL-_
+	REDO = "\033_" // ALT-_
+)
+
+func TestUndoTyping(t *testing.T) {
+	h := start(&echoHandler{}, 30, 5)
+
+	// a run of typed characters is undone at once, cursor movements start a new run
+	h.Type("one two")
+	h.Keys(repltest.CTRL_A)
+	h.Type("x")
+	assertRows(t, h, "> xone two")
+
+	h.Keys(UNDO)
+	assertRows(t, h, "> one two")
+	assertCursor(t, h, 2, 0)
+
+	h.Keys(UNDO)
+	assertRows(t, h, ">")
+
+	// nothing left to undo
+	h.Keys(UNDO)
+	assertRows(t, h, ">")
+
+	// undo and redo aren't edits themselves, so both can be redone
+	// the cursor returns to where it was when the edit was undone
+	h.Keys(REDO)
+	assertRows(t, h, "> one two")
+	assertCursor(t, h, 2, 0)
+
+	h.Keys(REDO)
+	assertRows(t, h, "> xone two")
+	assertCursor(t, h, 3, 0)
+}
+
+func TestUndoKillAndYank(t *testing.T) {
+	h := start(&echoHandler{}, 30, 5)
+
+	h.Type("one two")
+	h.Keys(repltest.CTRL_W, repltest.CTRL_Y, repltest.CTRL_Y)
+	assertRows(t, h, "> one twotwo")
+
+	h.Keys(UNDO)
+	assertRows(t, h, "> one two")
+
+	h.Keys(UNDO)
+	assertRows(t, h, "> one")
+
+	h.Keys(REDO, REDO)
+	assertRows(t, h, "> one twotwo")
+
+	h.Keys(UNDO, UNDO, UNDO)
+	assertRows(t, h, "> one two")
+}
+
+func TestRedoClearedByEdit(t *testing.T) {
+	h := start(&echoHandler{}, 30, 5)
+
+	h.Type("ab")
+	h.Keys(UNDO)
+	h.Type("x")
+
+	h.Keys(REDO)
+	assertRows(t, h, "> x")
+
+	h.Keys(UNDO)
+	assertRows(t, h, ">")
+}
+
+func TestUndoPerLine(t *testing.T) {
+	h := start(&echoHandler{}, 30, 5)
+
+	h.Type("ab")
+	h.Keys(repltest.ENTER)
+	assertRows(t, h, "> ab", "ab", ">")
+
+	// the evaluation isn't an edit, and the previous line can't be restored
+	h.Keys(UNDO)
+	assertRows(t, h, "> ab", "ab", ">")
+
+	h.Type("c")
+	h.Keys(UNDO, UNDO)
+	assertRows(t, h, "> ab", "ab", ">")
+}
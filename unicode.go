@@ -0,0 +1,187 @@
+package repl
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// The buffer is edited per grapheme cluster (i.e. what the user perceives as a single character), so bufferPos, viewStart and viewEnd are always byte offsets at cluster boundaries.
+
+// call fn for every grapheme cluster in b, with its start and stop byte offsets and its display width (0, 1 or 2 columns)
+// stop iterating if fn returns false
+func forEachGrapheme(b []byte, fn func(start, stop, width int) bool) {
+	state := -1
+	start := 0
+	rest := b
+
+	for len(rest) > 0 {
+		var cluster []byte
+		var width int
+
+		cluster, rest, width, state = uniseg.FirstGraphemeCluster(rest, state)
+
+		stop := start + len(cluster)
+
+		if !fn(start, stop, width) {
+			return
+		}
+
+		start = stop
+	}
+}
+
+// byte offset of the end of the cluster starting at pos
+func nextGraphemePos(b []byte, pos int) int {
+	res := len(b)
+
+	forEachGrapheme(b, func(start, stop, _ int) bool {
+		if start >= pos {
+			res = stop
+			return false
+		}
+
+		return true
+	})
+
+	return res
+}
+
+// byte offset of the start of the cluster ending at pos
+func prevGraphemePos(b []byte, pos int) int {
+	res := 0
+
+	forEachGrapheme(b, func(start, stop, _ int) bool {
+		if stop >= pos {
+			res = start
+			return false
+		}
+
+		return true
+	})
+
+	return res
+}
+
+// round pos up to the nearest cluster boundary
+func snapGraphemePos(b []byte, pos int) int {
+	if pos <= 0 {
+		return 0
+	} else if pos >= len(b) {
+		return len(b)
+	}
+
+	res := len(b)
+
+	forEachGrapheme(b, func(start, stop, _ int) bool {
+		if start >= pos {
+			res = start
+			return false
+		}
+
+		return true
+	})
+
+	return res
+}
+
+func isGraphemeBoundary(b []byte, pos int) bool {
+	return snapGraphemePos(b, pos) == pos
+}
+
+// number of columns used by s in the terminal
+func displayWidth(s string) int {
+	return uniseg.StringWidth(s)
+}
+
+// remove the escape sequences that don't use any columns (e.g. SGR colors, and OSC window titles or hyperlinks)
+func stripEscapes(s string) string {
+	if strings.IndexByte(s, '\033') < 0 {
+		return s
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); {
+		if s[i] != '\033' {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		i++
+		if i >= len(s) {
+			break
+		}
+
+		switch s[i] {
+		case '[':
+			// CSI: parameter and intermediate bytes, terminated by a final byte
+			i++
+			for i < len(s) && (s[i] < 0x40 || s[i] > 0x7e) {
+				i++
+			}
+			i++
+		case ']':
+			// OSC: terminated by BEL or ST
+			i++
+			for i < len(s) {
+				if s[i] == '\a' {
+					i++
+					break
+				} else if s[i] == '\033' && i+1 < len(s) && s[i+1] == '\\' {
+					i += 2
+					break
+				}
+
+				i++
+			}
+		default:
+			i++
+		}
+	}
+
+	return b.String()
+}
+
+// cut off s so that it uses at most w columns
+func truncateToWidth(s string, w int) string {
+	b := []byte(s)
+	res := 0
+	x := 0
+
+	forEachGrapheme(b, func(start, stop, width int) bool {
+		if x+width > w {
+			return false
+		}
+
+		x += width
+		res = stop
+
+		return true
+	})
+
+	return s[0:res]
+}
+
+// remove control characters and invalid utf-8, tabs are replaced by a space
+func cleanInput(msg []byte) []byte {
+	filtered := make([]byte, 0, len(msg))
+
+	for len(msg) > 0 {
+		c, size := utf8.DecodeRune(msg)
+
+		if c == '\t' {
+			filtered = append(filtered, ' ')
+		} else if c == utf8.RuneError && size <= 1 {
+			// invalid byte
+		} else if c >= 32 && c != 127 && !(c >= 0x80 && c < 0xa0) {
+			filtered = append(filtered, msg[0:size]...)
+		}
+
+		msg = msg[size:]
+	}
+
+	return filtered
+}
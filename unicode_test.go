@@ -0,0 +1,57 @@
+package repl
+
+import (
+	"testing"
+)
+
+func TestStripEscapes(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{"plain", "abc", "abc"},
+		{"sgr", "\033[1;31mred\033[0m!", "red!"},
+		{"sgr without parameters", "\033[mx", "x"},
+		{"osc terminated by bel", "\033]0;title\atext", "text"},
+		{"osc terminated by st", "\033]8;;http://example.com\033\\link\033]8;;\033\\", "link"},
+		{"two byte escape", "\033=x", "x"},
+		{"incomplete csi", "ab\033[1;3", "ab"},
+		{"incomplete osc", "ab\033]0;title", "ab"},
+		{"lone escape", "ab\033", "ab"},
+		{"wide characters", "世\033[1m界\033[0m", "世界"},
+	}
+
+	for _, test := range tests {
+		if got := stripEscapes(test.s); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestTruncateToWidth(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		w    int
+		want string
+	}{
+		{"fits", "abc", 5, "abc"},
+		{"exact", "abc", 3, "abc"},
+		{"truncated", "abc", 2, "ab"},
+		{"zero width", "abc", 0, ""},
+		{"negative width", "abc", -1, ""},
+		{"wide characters", "世界", 4, "世界"},
+		// half of a wide character isn't shown
+		{"wide character cut", "世界", 3, "世"},
+		{"wide character after ascii", "a世", 2, "a"},
+		{"combining accent", "e\u0301x", 1, "e\u0301"},
+		{"joined emoji", "\U0001F468‍\U0001F469‍\U0001F467x", 2, "\U0001F468‍\U0001F469‍\U0001F467"},
+	}
+
+	for _, test := range tests {
+		if got := truncateToWidth(test.s, test.w); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,720 @@
+package repl
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	_VI_MOTIONS   = "hlwbeWBE0^$fFtT;,"
+	_VI_OPERATORS = "dcy"
+	_VI_COMMANDS  = "iaIAxXsSDCpPr~u.jk"
+)
+
+// WORDs are separated by whitespace, words are the phrases of Repl.phraseRe
+var viBigWordRe = regexp.MustCompile(`\S+`)
+
+// a parsed normal mode command, e.g. `3dw`, `fx` or `p`
+type _ViCommand struct {
+	count int  // 0 if no count was typed
+	op    rune // 'd', 'c', 'y', or 0 for a motion or a simple command
+	cmd   rune // motion or simple command, '_' for a whole line (e.g. `dd`)
+	arg   rune // character argument of f, F, t, T and r
+}
+
+// _ViState is the state of the vi editing mode, see Repl.SetViMode
+type _ViState struct {
+	normal     bool
+	keys       []Key       // the normal mode command typed so far
+	lastFind   _ViCommand  // repeated by ; and ,
+	lastChange *_ViCommand // repeated by .
+	inserted   []Key       // keys typed in insert mode after lastChange
+	recording  bool        // insert mode was entered by lastChange
+	replaying  bool
+}
+
+func newViState() *_ViState {
+	return &_ViState{
+		normal:     false,
+		keys:       make([]Key, 0),
+		lastFind:   _ViCommand{},
+		lastChange: nil,
+		inserted:   make([]Key, 0),
+		recording:  false,
+		replaying:  false,
+	}
+}
+
+func (c _ViCommand) times() int {
+	if c.count == 0 {
+		return 1
+	}
+
+	return c.count
+}
+
+// each line starts in insert mode
+func (v *_ViState) reset() {
+	v.normal = false
+	v.keys = v.keys[:0]
+	v.recording = false
+}
+
+func (v *_ViState) modeName() string {
+	if v.normal {
+		return "NORMAL"
+	} else {
+		return "INSERT"
+	}
+}
+
+// the arrow keys etc. are aliases of the vi motions
+func viRune(k Key) (rune, bool) {
+	switch {
+	case k.isText():
+		return k.Rune, true
+	case k.is(KEY_LEFT, 0), k.is(KEY_BACKSPACE, 0):
+		return 'h', true
+	case k.is(KEY_RIGHT, 0):
+		return 'l', true
+	case k.is(KEY_HOME, 0):
+		return '0', true
+	case k.is(KEY_END, 0):
+		return '$', true
+	case k.is(KEY_DELETE, 0):
+		return 'x', true
+	default:
+		return 0, false
+	}
+}
+
+// returns the command, whether the command is complete, and whether the runes can be (the start of) a valid command
+func parseViCommand(rs []rune) (_ViCommand, bool, bool) {
+	cmd := _ViCommand{}
+
+	i := 0
+
+	// a leading 0 is a motion, not a count
+	parseCount := func() int {
+		n := 0
+		for i < len(rs) && rs[i] >= '0' && rs[i] <= '9' && !(n == 0 && rs[i] == '0') {
+			n = n*10 + int(rs[i]-'0')
+			i++
+		}
+
+		return n
+	}
+
+	cmd.count = parseCount()
+	if i == len(rs) {
+		return cmd, false, true
+	}
+
+	if strings.ContainsRune(_VI_OPERATORS, rs[i]) {
+		cmd.op = rs[i]
+		i++
+
+		// counts are multiplied, e.g. `2d3w` deletes 6 words
+		if n := parseCount(); n > 0 {
+			cmd.count = cmd.times() * n
+		}
+
+		if i == len(rs) {
+			return cmd, false, true
+		} else if rs[i] == cmd.op {
+			cmd.cmd = '_'
+			return cmd, true, true
+		} else if !strings.ContainsRune(_VI_MOTIONS, rs[i]) {
+			return cmd, false, false
+		}
+	} else if !strings.ContainsRune(_VI_MOTIONS+_VI_COMMANDS, rs[i]) {
+		return cmd, false, false
+	}
+
+	cmd.cmd = rs[i]
+	i++
+
+	if strings.ContainsRune("fFtTr", cmd.cmd) {
+		if i == len(rs) {
+			return cmd, false, true
+		}
+
+		cmd.arg = rs[i]
+	}
+
+	return cmd, true, true
+}
+
+// in normal mode the cursor is on a character, not after the last character of a line
+func viClamp(buffer []byte, pos int) int {
+	start, end := lineStart(buffer, pos), lineEnd(buffer, pos)
+
+	if pos >= end && end > start {
+		return prevGraphemePos(buffer, end)
+	}
+
+	return pos
+}
+
+// returns false if the keystroke isn't handled by the vi mode, and must be dispatched as usual
+func (r *Repl) dispatchVi(k Key) bool {
+	v := r.vi
+
+	if r.searchActive() {
+		return false
+	}
+
+	if !v.normal {
+		if k.is(KEY_ESCAPE, 0) {
+			r.viNormalMode()
+			return true
+		}
+
+		if v.recording && !v.replaying {
+			v.inserted = append(v.inserted, k)
+		}
+
+		// the text typed before the first normal mode command can be undone too
+		if len(r.undoStack) == 0 {
+			r.saveUndo()
+		}
+
+		return false
+	}
+
+	if k.is(KEY_ESCAPE, 0) {
+		v.keys = v.keys[:0]
+		return true
+	}
+
+	if _, ok := viRune(k); !ok {
+		// e.g. RETURN or CTRL-R
+		v.keys = v.keys[:0]
+		return false
+	}
+
+	v.keys = append(v.keys, k)
+
+	rs := make([]rune, len(v.keys))
+	for i, key := range v.keys {
+		rs[i], _ = viRune(key)
+	}
+
+	cmd, complete, valid := parseViCommand(rs)
+	if !valid {
+		v.keys = v.keys[:0]
+	} else if complete {
+		v.keys = v.keys[:0]
+		r.execVi(cmd)
+	}
+
+	return true
+}
+
+func (r *Repl) viNormalMode() {
+	v := r.vi
+
+	v.normal = true
+	v.recording = false
+
+	// the cursor moves onto the last inserted character
+	pos := r.bufferPos
+	if pos > lineStart(r.buffer, pos) {
+		pos = prevGraphemePos(r.buffer, pos)
+	}
+
+	r.viMoveTo(pos)
+
+	r.clearStatus()
+	r.writeStatus()
+}
+
+func (r *Repl) viInsertMode(pos int) {
+	r.vi.normal = false
+
+	r.viMoveTo(pos)
+
+	r.clearStatus()
+	r.writeStatus()
+}
+
+func (r *Repl) viMoveTo(pos int) {
+	if pos == r.bufferPos {
+		return
+	}
+
+	r.bufferPos = pos
+
+	r.syncCursorOverflow()
+}
+
+// replace the buffer, the cursor stays on a character
+func (r *Repl) viSetBuffer(buffer []byte, pos int) {
+	r.force(buffer, viClamp(buffer, pos))
+}
+
+// shorthands for operator commands
+var viAliases = map[rune]_ViCommand{
+	'x': {op: 'd', cmd: 'l'},
+	'X': {op: 'd', cmd: 'h'},
+	's': {op: 'c', cmd: 'l'},
+	'S': {op: 'c', cmd: '_'},
+	'D': {op: 'd', cmd: '$'},
+	'C': {op: 'c', cmd: '$'},
+}
+
+func (r *Repl) execVi(cmd _ViCommand) {
+	v := r.vi
+
+	if alias, ok := viAliases[cmd.cmd]; ok && cmd.op == 0 {
+		alias.count = cmd.count
+		cmd = alias
+	}
+
+	if cmd.op == 'd' || cmd.op == 'c' || strings.ContainsRune("iaIApPr~", cmd.cmd) {
+		r.saveUndo()
+
+		if !v.replaying {
+			change := cmd
+			v.lastChange = &change
+			v.inserted = v.inserted[:0]
+			v.recording = cmd.op == 'c' || strings.ContainsRune("iaIA", cmd.cmd)
+		}
+	}
+
+	if cmd.op != 0 {
+		r.viOperate(cmd)
+		return
+	}
+
+	n := cmd.times()
+	pos := r.bufferPos
+
+	switch cmd.cmd {
+	case 'i':
+		r.viInsertMode(pos)
+	case 'a':
+		if pos < lineEnd(r.buffer, pos) {
+			pos = nextGraphemePos(r.buffer, pos)
+		}
+
+		r.viInsertMode(pos)
+	case 'I':
+		target, _, _ := r.viMotion(_ViCommand{cmd: '^'})
+		r.viInsertMode(target)
+	case 'A':
+		r.viInsertMode(lineEnd(r.buffer, pos))
+	case 'p', 'P':
+		r.viPut(cmd.cmd == 'p', n)
+	case 'r':
+		r.viReplace(cmd.arg, n)
+	case '~':
+		r.viToggleCase(n)
+	case 'u':
+		for i := 0; i < n; i++ {
+			if !r.undo() {
+				break
+			}
+		}
+
+		r.viMoveTo(viClamp(r.buffer, r.bufferPos))
+	case '.':
+		r.viRepeat(cmd.count)
+	case 'j':
+		r.moveDownOrHistoryForward()
+	case 'k':
+		r.moveUpOrHistoryBack()
+	default:
+		if target, _, ok := r.viMotion(cmd); ok {
+			r.viMoveTo(viClamp(r.buffer, target))
+		}
+	}
+}
+
+// returns the target position of the motion, and whether the character at the target is included by an operator
+func (r *Repl) viMotion(cmd _ViCommand) (int, bool, bool) {
+	v := r.vi
+	b := r.buffer
+	pos := r.bufferPos
+	n := cmd.times()
+
+	start, end := lineStart(b, pos), lineEnd(b, pos)
+
+	switch cmd.cmd {
+	case 'h':
+		for i := 0; i < n && pos > start; i++ {
+			pos = prevGraphemePos(b, pos)
+		}
+
+		return pos, false, true
+	case 'l':
+		for i := 0; i < n && pos < end; i++ {
+			pos = nextGraphemePos(b, pos)
+		}
+
+		return pos, false, true
+	case '0':
+		return start, false, true
+	case '^':
+		for pos = start; pos < end && (b[pos] == ' ' || b[pos] == '\t'); pos++ {
+		}
+
+		return pos, false, true
+	case '$':
+		return end, false, true
+	case 'w', 'W':
+		for i := 0; i < n; i++ {
+			pos = r.viNextWordStart(cmd.cmd == 'W', pos)
+		}
+
+		return pos, false, true
+	case 'b', 'B':
+		for i := 0; i < n; i++ {
+			pos = r.viPrevWordStart(cmd.cmd == 'B', pos)
+		}
+
+		return pos, false, true
+	case 'e', 'E':
+		for i := 0; i < n; i++ {
+			next, ok := r.viNextWordEnd(cmd.cmd == 'E', pos)
+			if !ok {
+				return pos, true, i > 0
+			}
+
+			pos = next
+		}
+
+		return pos, true, true
+	case 'f', 'F', 't', 'T':
+		v.lastFind = cmd
+
+		return r.viFind(cmd.cmd, cmd.arg, n)
+	case ';', ',':
+		find := v.lastFind
+		if find.cmd == 0 {
+			return pos, false, false
+		}
+
+		if cmd.cmd == ',' {
+			find.cmd = map[rune]rune{'f': 'F', 'F': 'f', 't': 'T', 'T': 't'}[find.cmd]
+		}
+
+		return r.viFind(find.cmd, find.arg, n)
+	default:
+		return pos, false, false
+	}
+}
+
+func (r *Repl) viWords(big bool) [][]int {
+	if big {
+		return viBigWordRe.FindAllIndex(r.buffer, -1)
+	}
+
+	return r.phraseRe.FindAllIndex(r.buffer, -1)
+}
+
+func (r *Repl) viNextWordStart(big bool, pos int) int {
+	for _, word := range r.viWords(big) {
+		if word[0] > pos {
+			return word[0]
+		}
+	}
+
+	return r.bufferLen()
+}
+
+func (r *Repl) viPrevWordStart(big bool, pos int) int {
+	words := r.viWords(big)
+
+	for i := len(words) - 1; i >= 0; i-- {
+		if words[i][0] < pos {
+			return words[i][0]
+		}
+	}
+
+	return 0
+}
+
+// position of the last character of the current or next word
+func (r *Repl) viNextWordEnd(big bool, pos int) (int, bool) {
+	for _, word := range r.viWords(big) {
+		last := prevGraphemePos(r.buffer, word[1])
+		if last > pos {
+			return last, true
+		}
+	}
+
+	return pos, false
+}
+
+// f and t search forward, F and T search backward, on the current line
+func (r *Repl) viFind(cmd rune, c rune, n int) (int, bool, bool) {
+	b := r.buffer
+	pos := r.bufferPos
+	start, end := lineStart(b, pos), lineEnd(b, pos)
+
+	target := pos
+	found := 0
+
+	if cmd == 'f' || cmd == 't' {
+		for p := nextGraphemePos(b, pos); p < end && found < n; p = nextGraphemePos(b, p) {
+			if rr, _ := utf8.DecodeRune(b[p:]); rr == c {
+				target = p
+				found++
+			}
+		}
+
+		if found < n {
+			return pos, false, false
+		}
+
+		if cmd == 't' {
+			target = prevGraphemePos(b, target)
+		}
+
+		return target, true, true
+	}
+
+	for p := pos; p > start && found < n; {
+		p = prevGraphemePos(b, p)
+
+		if rr, _ := utf8.DecodeRune(b[p:]); rr == c {
+			target = p
+			found++
+		}
+	}
+
+	if found < n {
+		return pos, false, false
+	}
+
+	if cmd == 'T' {
+		target = nextGraphemePos(b, target)
+	}
+
+	return target, false, true
+}
+
+// the span of the buffer affected by an operator
+func (r *Repl) viRange(cmd _ViCommand) (int, int, bool) {
+	b := r.buffer
+	pos := r.bufferPos
+
+	if cmd.cmd == '_' {
+		// whole lines
+		from, to := lineStart(b, pos), lineEnd(b, pos)
+
+		for i := 1; i < cmd.times() && to < len(b); i++ {
+			to = lineEnd(b, to+1)
+		}
+
+		if cmd.op == 'd' {
+			// including the newline
+			if to < len(b) {
+				to++
+			} else if from > 0 {
+				from--
+			}
+		}
+
+		return from, to, true
+	}
+
+	// `cw` changes up to the end of the current word, like `ce` but including the character under the cursor
+	if cmd.op == 'c' && (cmd.cmd == 'w' || cmd.cmd == 'W') && pos < len(b) && b[pos] != ' ' && b[pos] != '\n' {
+		target := pos
+		for i := 0; i < cmd.times(); i++ {
+			next, ok := r.viNextWordEnd(cmd.cmd == 'W', target-1)
+			if !ok {
+				break
+			}
+
+			target = nextGraphemePos(b, next)
+		}
+
+		return pos, target, target > pos
+	}
+
+	target, inclusive, ok := r.viMotion(cmd)
+	if !ok {
+		return pos, pos, false
+	}
+
+	from, to := pos, target
+	if to < from {
+		from, to = to, from
+	}
+
+	if inclusive && to < len(b) {
+		to = nextGraphemePos(b, to)
+	}
+
+	return from, to, true
+}
+
+func (r *Repl) viOperate(cmd _ViCommand) {
+	from, to, ok := r.viRange(cmd)
+	if !ok {
+		if cmd.op == 'c' {
+			r.vi.recording = false
+		}
+
+		return
+	}
+
+	text := copyBytes(r.buffer[from:to])
+
+	if cmd.op == 'y' {
+		r.kill(text, false)
+
+		// yanking whole lines doesn't move the cursor
+		if cmd.cmd != '_' {
+			r.viMoveTo(viClamp(r.buffer, from))
+		}
+
+		return
+	}
+
+	r.kill(text, false)
+
+	newBuffer := make([]byte, 0, len(r.buffer)-len(text))
+	newBuffer = append(newBuffer, r.buffer[0:from]...)
+	newBuffer = append(newBuffer, r.buffer[to:]...)
+
+	if cmd.op == 'c' {
+		r.force(newBuffer, from)
+		r.viInsertMode(from)
+	} else {
+		r.viSetBuffer(newBuffer, from)
+	}
+}
+
+// p puts the most recent deletion or yank after the cursor, P before the cursor
+func (r *Repl) viPut(after bool, n int) {
+	kill := r.lastKill()
+	if len(kill) == 0 {
+		return
+	}
+
+	pos := r.bufferPos
+	if after && pos < r.bufferLen() {
+		pos = nextGraphemePos(r.buffer, pos)
+	}
+
+	text := bytes.Repeat(kill, n)
+
+	newBuffer := make([]byte, 0, len(r.buffer)+len(text))
+	newBuffer = append(newBuffer, r.buffer[0:pos]...)
+	newBuffer = append(newBuffer, text...)
+	newBuffer = append(newBuffer, r.buffer[pos:]...)
+
+	// the cursor ends up on the last put character
+	r.viSetBuffer(newBuffer, prevGraphemePos(newBuffer, pos+len(text)))
+}
+
+// replace n characters, without crossing the end of the line
+func (r *Repl) viReplace(c rune, n int) {
+	b := r.buffer
+	pos := r.bufferPos
+	end := lineEnd(b, pos)
+
+	stop := pos
+	for i := 0; i < n; i++ {
+		if stop >= end {
+			return
+		}
+
+		stop = nextGraphemePos(b, stop)
+	}
+
+	replacement := []byte(strings.Repeat(string(c), n))
+
+	newBuffer := make([]byte, 0)
+	newBuffer = append(newBuffer, b[0:pos]...)
+	newBuffer = append(newBuffer, replacement...)
+	newBuffer = append(newBuffer, b[stop:]...)
+
+	r.viSetBuffer(newBuffer, pos+len(replacement)-utf8.RuneLen(c))
+}
+
+func (r *Repl) viToggleCase(n int) {
+	b := r.buffer
+	pos := r.bufferPos
+	end := lineEnd(b, pos)
+
+	stop := pos
+	for i := 0; i < n && stop < end; i++ {
+		stop = nextGraphemePos(b, stop)
+	}
+
+	toggled := bytes.Map(func(c rune) rune {
+		if unicode.IsUpper(c) {
+			return unicode.ToLower(c)
+		}
+
+		return unicode.ToUpper(c)
+	}, b[pos:stop])
+
+	newBuffer := make([]byte, 0)
+	newBuffer = append(newBuffer, b[0:pos]...)
+	newBuffer = append(newBuffer, toggled...)
+	newBuffer = append(newBuffer, b[stop:]...)
+
+	r.viSetBuffer(newBuffer, pos+len(toggled))
+}
+
+// repeat the last change, including the text typed in insert mode
+func (r *Repl) viRepeat(count int) {
+	v := r.vi
+
+	if v.lastChange == nil {
+		return
+	}
+
+	cmd := *v.lastChange
+	if count > 0 {
+		cmd.count = count
+	}
+
+	v.replaying = true
+	defer func() {
+		v.replaying = false
+	}()
+
+	r.execVi(cmd)
+
+	if !v.normal {
+		for _, k := range v.inserted {
+			if k.is(KEY_ENTER, 0) {
+				break
+			}
+
+			r.dispatch(k)
+		}
+
+		r.viNormalMode()
+	}
+}
+
+// Enable or disable the vi editing mode. Every line starts in insert mode, ESC switches to normal mode. The current mode is shown in the status bar.
+//
+// Normal mode supports the motions h, l, w, b, e, W, B, E, 0, ^, $, f, F, t, T, ; and ,, the operators d, c and y (combined with a motion, or doubled for the whole line), counts,
+// and the commands i, a, I, A, x, X, s, S, D, C, p, P, r, ~, u, . and j/k for the history.
+// Other keys (e.g. RETURN, TAB and CTRL-R) keep their usual bindings in both modes.
+func (r *Repl) SetViMode(enabled bool) {
+	r.do(func() {
+		if enabled && r.vi == nil {
+			r.vi = newViState()
+		} else if !enabled {
+			r.vi = nil
+		}
+
+		if r.running() && !r.evaluating {
+			r.clearStatus()
+			r.writeStatus()
+		}
+	})
+}
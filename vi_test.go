@@ -0,0 +1,52 @@
+package repl
+
+import (
+	"testing"
+)
+
+func TestParseViCommand(t *testing.T) {
+	tests := []struct {
+		keys     string
+		cmd      _ViCommand
+		complete bool
+		valid    bool
+	}{
+		{"", _ViCommand{}, false, true},
+		{"w", _ViCommand{cmd: 'w'}, true, true},
+		{"3w", _ViCommand{count: 3, cmd: 'w'}, true, true},
+		{"12l", _ViCommand{count: 12, cmd: 'l'}, true, true},
+		{"3", _ViCommand{count: 3}, false, true},
+		// a leading 0 is a motion, not a count
+		{"0", _ViCommand{cmd: '0'}, true, true},
+		{"10x", _ViCommand{count: 10, cmd: 'x'}, true, true},
+		{"d", _ViCommand{op: 'd'}, false, true},
+		{"dw", _ViCommand{op: 'd', cmd: 'w'}, true, true},
+		{"c$", _ViCommand{op: 'c', cmd: '$'}, true, true},
+		{"2d3w", _ViCommand{count: 6, op: 'd', cmd: 'w'}, true, true},
+		{"d3", _ViCommand{count: 3, op: 'd'}, false, true},
+		{"dd", _ViCommand{op: 'd', cmd: '_'}, true, true},
+		{"2yy", _ViCommand{count: 2, op: 'y', cmd: '_'}, true, true},
+		{"f", _ViCommand{cmd: 'f'}, false, true},
+		{"fx", _ViCommand{cmd: 'f', arg: 'x'}, true, true},
+		{"2T ", _ViCommand{count: 2, cmd: 'T', arg: ' '}, true, true},
+		{"dt", _ViCommand{op: 'd', cmd: 't'}, false, true},
+		{"dtx", _ViCommand{op: 'd', cmd: 't', arg: 'x'}, true, true},
+		{"r", _ViCommand{cmd: 'r'}, false, true},
+		{"3rz", _ViCommand{count: 3, cmd: 'r', arg: 'z'}, true, true},
+		// commands that aren't motions can't follow an operator
+		{"di", _ViCommand{op: 'd'}, false, false},
+		{"dc", _ViCommand{op: 'd'}, false, false},
+		{"q", _ViCommand{}, false, false},
+		{"2q", _ViCommand{count: 2}, false, false},
+	}
+
+	for _, test := range tests {
+		cmd, complete, valid := parseViCommand([]rune(test.keys))
+
+		if complete != test.complete || valid != test.valid {
+			t.Errorf("%q: expected complete=%v valid=%v, got complete=%v valid=%v", test.keys, test.complete, test.valid, complete, valid)
+		} else if cmd != test.cmd {
+			t.Errorf("%q: expected %+v, got %+v", test.keys, test.cmd, cmd)
+		}
+	}
+}